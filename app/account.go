@@ -0,0 +1,304 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/calaos/calaos_dns/config"
+	"github.com/calaos/calaos_dns/models"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+)
+
+// initAccounts registers the account API. It is only available when a JWT
+// secret is set in the config file.
+func initAccounts() {
+	if config.Conf.Accounts.JwtSecret == "" {
+		return
+	}
+
+	e.POST("/api/account/signup", AccountSignup, rateLimit)
+	e.POST("/api/account/login", AccountLogin, rateLimit)
+
+	g := e.Group("/api/account", accountAuth)
+
+	g.GET("", GetAccount)
+	g.POST("/apikey", CreateAccountApiKey)
+	g.GET("/hosts", ListAccountHosts)
+	g.POST("/hosts", RegisterAccountHost, rateLimit)
+	g.POST("/hosts/claim", ClaimAccountHost)
+	g.GET("/hosts/:hostname", GetAccountHost)
+	g.DELETE("/hosts/:hostname", DeleteAccountHost)
+	g.PUT("/hosts/:hostname/ip", UpdateAccountHost)
+	g.POST("/hosts/:hostname/tokens", CreateAccountHostToken)
+	g.POST("/hosts/:hostname/transfer", TransferAccountHost)
+}
+
+type AccountJson struct {
+	Email    string `json:"email" form:"email"`
+	Password string `json:"password" form:"password"`
+}
+
+type SessionJson struct {
+	Account   *models.Account `json:"account"`
+	Token     string          `json:"token"`
+	ExpiresAt time.Time       `json:"expires_at"`
+}
+
+// newSession returns a signed JWT for the account
+func newSession(a *models.Account) (*SessionJson, error) {
+	hours := config.Conf.Accounts.TokenHours
+	if hours <= 0 {
+		hours = 24
+	}
+
+	now := time.Now()
+	s := &SessionJson{
+		Account:   a,
+		ExpiresAt: now.Add(time.Duration(hours) * time.Hour),
+	}
+
+	claims := jwt.StandardClaims{
+		Subject:   strconv.FormatInt(a.ID, 10),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: s.ExpiresAt.Unix(),
+	}
+
+	var err error
+	s.Token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(config.Conf.Accounts.JwtSecret))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal error")
+	}
+
+	return s, nil
+}
+
+// sessionAccount returns the account of a JWT issued by newSession
+func sessionAccount(token string) (*models.Account, error) {
+	claims := &jwt.StandardClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method %v", t.Header["alg"])
+		}
+		return []byte(config.Conf.Accounts.JwtSecret), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return models.GetAccount(id)
+}
+
+// accountAuth authenticates the account of the request with the JWT of its
+// session or its API key, sent as a Bearer token
+func accountAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		auth := c.Request().Header.Get(echo.HeaderAuthorization)
+		if len(auth) <= 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Missing credentials")
+		}
+		token := strings.TrimSpace(auth[7:])
+
+		var a *models.Account
+		var err error
+		if strings.Count(token, ".") == 2 {
+			a, err = sessionAccount(token)
+		} else {
+			a, err = models.GetAccountByApiKey(token)
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Invalid credentials")
+		}
+
+		c.Set("account", a)
+		return next(c)
+	}
+}
+
+func currentAccount(c echo.Context) *models.Account {
+	return c.Get("account").(*models.Account)
+}
+
+func AccountSignup(c echo.Context) (err error) {
+	req := &AccountJson{}
+	if err = c.Bind(req); err != nil {
+		return err
+	}
+
+	a, err := models.CreateAccount(req.Email, req.Password)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%v", err))
+	}
+
+	s, err := newSession(a)
+	if err != nil {
+		return
+	}
+
+	return c.JSON(http.StatusCreated, s)
+}
+
+func AccountLogin(c echo.Context) (err error) {
+	req := &AccountJson{}
+	if err = c.Bind(req); err != nil {
+		return err
+	}
+
+	a, err := models.Login(req.Email, req.Password)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, fmt.Sprintf("%v", err))
+	}
+
+	s, err := newSession(a)
+	if err != nil {
+		return
+	}
+
+	return c.JSON(http.StatusOK, s)
+}
+
+func GetAccount(c echo.Context) (err error) {
+	return c.JSON(http.StatusOK, currentAccount(c))
+}
+
+// CreateAccountApiKey replaces the API key of the account. The key is only
+// sent once.
+func CreateAccountApiKey(c echo.Context) (err error) {
+	key, err := models.CreateApiKey(currentAccount(c))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("%v", err))
+	}
+
+	return c.JSON(http.StatusCreated, map[string]string{"api_key": key})
+}
+
+func ListAccountHosts(c echo.Context) (err error) {
+	hosts, err := models.AccountHosts(currentAccount(c))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("%v", err))
+	}
+
+	details := []models.HostDetails{}
+	for i := range hosts {
+		details = append(details, *models.NewHostDetails(&hosts[i], false))
+	}
+
+	return c.JSON(http.StatusOK, details)
+}
+
+// RegisterAccountHost registers a new host owned by the account. The token
+// of the host is returned as in /api/register.
+func RegisterAccountHost(c echo.Context) (err error) {
+	req := &RegisterJson{}
+	if err = c.Bind(req); err != nil {
+		return err
+	}
+
+	ip, ipv6 := requestAddresses(c, req.IP, req.IPv6)
+
+	token, err := models.RegisterAccountHost(currentAccount(c), req.Mainzone, req.Subzones, ip, ipv6, clientIP(c))
+	if err == models.ErrTooManyHosts {
+		return echo.NewHTTPError(http.StatusTooManyRequests, fmt.Sprintf("%v", err))
+	} else if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%v", err))
+	}
+
+	req.IP = ip
+	req.IPv6 = ipv6
+	req.Token = token
+
+	return c.JSON(http.StatusCreated, req)
+}
+
+// ClaimAccountHost adds an anonymous host to the account, with its full token
+func ClaimAccountHost(c echo.Context) (err error) {
+	req := &TokenJson{}
+	if err = c.Bind(req); err != nil {
+		return err
+	}
+
+	h, err := models.ClaimHost(currentAccount(c), req.Token)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%v", err))
+	}
+
+	return c.JSON(http.StatusOK, models.NewHostDetails(h, false))
+}
+
+func GetAccountHost(c echo.Context) (err error) {
+	h, err := models.AccountHost(currentAccount(c), c.Param("hostname"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("%v", err))
+	}
+
+	return c.JSON(http.StatusOK, models.NewHostDetails(h, true))
+}
+
+func DeleteAccountHost(c echo.Context) (err error) {
+	err = models.DeleteAccountHost(currentAccount(c), c.Param("hostname"))
+	if err != nil {
+		return hostError(err)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func UpdateAccountHost(c echo.Context) (err error) {
+	req := &AdminAddressesJson{}
+	if err = c.Bind(req); err != nil {
+		return err
+	}
+
+	h, err := models.UpdateAccountHost(currentAccount(c), c.Param("hostname"), req.IP, req.IPv6)
+	if err != nil {
+		return hostError(err)
+	}
+
+	return c.JSON(http.StatusOK, models.NewHostDetails(h, true))
+}
+
+func CreateAccountHostToken(c echo.Context) (err error) {
+	req := &TokenJson{}
+	if err = bindRequest(c, req); err != nil {
+		return err
+	}
+
+	if req.Scope == "" {
+		req.Scope = models.ScopeFull
+	}
+
+	token, t, err := models.CreateAccountHostToken(currentAccount(c), c.Param("hostname"), req.Label, req.Scope)
+	if err != nil {
+		return hostError(err)
+	}
+
+	return c.JSON(http.StatusCreated, &NewTokenJson{Token: *t, Value: token})
+}
+
+type TransferJson struct {
+	Email string `json:"email" form:"email"`
+}
+
+// TransferAccountHost gives a host of the account to another account
+func TransferAccountHost(c echo.Context) (err error) {
+	req := &TransferJson{}
+	if err = c.Bind(req); err != nil {
+		return err
+	}
+
+	h, err := models.TransferHost(currentAccount(c), c.Param("hostname"), req.Email)
+	if err != nil {
+		return hostError(err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"mainzone": h.Hostname, "owner": req.Email})
+}
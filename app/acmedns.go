@@ -0,0 +1,82 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/calaos/calaos_dns/models"
+
+	"github.com/labstack/echo"
+)
+
+type AcmeDnsRegisterJson struct {
+	AllowFrom []string `json:"allowfrom"`
+}
+
+type AcmeDnsUpdateJson struct {
+	Subdomain string `json:"subdomain,omitempty"`
+	Txt       string `json:"txt"`
+}
+
+type acmeDnsError struct {
+	Error string `json:"error"`
+}
+
+// AcmeDnsRegister creates an acme-dns account, see
+// https://github.com/joohoi/acme-dns#register-endpoint
+func AcmeDnsRegister(c echo.Context) (err error) {
+	req := &AcmeDnsRegisterJson{}
+	if c.Request().ContentLength > 0 {
+		if err = json.NewDecoder(c.Request().Body).Decode(req); err != nil {
+			return c.JSON(http.StatusBadRequest, acmeDnsError{"malformed_json_payload"})
+		}
+	}
+
+	reg, err := models.RegisterAcmeDns(req.AllowFrom, clientIP(c))
+	if err == models.ErrAcmeDnsBadAllowFrom {
+		return c.JSON(http.StatusBadRequest, acmeDnsError{err.Error()})
+	} else if err == models.ErrTooManyHosts {
+		return c.JSON(http.StatusTooManyRequests, acmeDnsError{"too_many_registrations"})
+	} else if err != nil {
+		return c.JSON(http.StatusInternalServerError, acmeDnsError{"db_error"})
+	}
+
+	return c.JSON(http.StatusCreated, reg)
+}
+
+// AcmeDnsUpdate publishes the TXT record of an acme-dns account, see
+// https://github.com/joohoi/acme-dns#update-endpoint
+func AcmeDnsUpdate(c echo.Context) (err error) {
+	//Clients do not always set the content type of the request
+	req := &AcmeDnsUpdateJson{}
+	if err = json.NewDecoder(c.Request().Body).Decode(req); err != nil {
+		return c.JSON(http.StatusBadRequest, acmeDnsError{"malformed_json_payload"})
+	}
+
+	user := c.Request().Header.Get("X-Api-User")
+	key := c.Request().Header.Get("X-Api-Key")
+	if ok, _ := models.AllowRequest(models.LimitToken, key); !ok {
+		return c.JSON(http.StatusTooManyRequests, acmeDnsError{"too_many_requests"})
+	}
+	h, err := verifySignature(c, key, models.ScopeAcme)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, acmeDnsError{"forbidden"})
+	}
+
+	err = models.UpdateAcmeDnsHost(h, user, req.Subdomain, req.Txt, clientIP(c))
+	switch err {
+	case nil:
+		return c.JSON(http.StatusOK, AcmeDnsUpdateJson{Txt: req.Txt})
+	case models.ErrAcmeDnsForbidden:
+		return c.JSON(http.StatusUnauthorized, acmeDnsError{err.Error()})
+	case models.ErrAcmeDnsBadSubdomain, models.ErrAcmeDnsBadTxt:
+		return c.JSON(http.StatusBadRequest, acmeDnsError{err.Error()})
+	default:
+		return c.JSON(http.StatusInternalServerError, acmeDnsError{"db_error"})
+	}
+}
+
+// AcmeDnsHealth is used by clients to check the service
+func AcmeDnsHealth(c echo.Context) error {
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,244 @@
+package app
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/calaos/calaos_dns/config"
+	"github.com/calaos/calaos_dns/models"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/middleware"
+)
+
+// initAdmin registers the admin API. It is only available when admin keys
+// are set in the config file.
+func initAdmin() {
+	if len(config.Conf.Admin.ApiKeys) == 0 {
+		return
+	}
+
+	g := e.Group("/api/admin", middleware.KeyAuth(isAdminKey))
+
+	g.GET("/dnssec", AdminDnssecStatus)
+	g.POST("/dnssec/enable", AdminDnssecEnable)
+	g.GET("/dnssec/ds", AdminDnssecDS)
+	g.POST("/dnssec/rollover", AdminDnssecRollover)
+
+	g.GET("/ratelimit", AdminRateLimit)
+
+	g.GET("/hosts", AdminListHosts)
+	g.GET("/hosts/:hostname", AdminGetHost)
+	g.DELETE("/hosts/:hostname", AdminDeleteHost)
+	g.PUT("/hosts/:hostname/ip", AdminSetHostAddresses)
+	g.POST("/hosts/:hostname/suspend", AdminSuspendHost)
+	g.POST("/hosts/:hostname/unsuspend", AdminUnsuspendHost)
+	g.POST("/hosts/:hostname/expire", AdminExpireHost)
+	g.PUT("/hosts/:hostname/owner", AdminSetHostOwner)
+
+	g.GET("/reserved", AdminListReserved)
+	g.POST("/reserved", AdminAddReserved)
+	g.DELETE("/reserved/:id", AdminDeleteReserved)
+}
+
+func isAdminKey(key string, c echo.Context) (bool, error) {
+	for _, k := range config.Conf.Admin.ApiKeys {
+		if k != "" && subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func AdminDnssecStatus(c echo.Context) (err error) {
+	status, err := models.GetDnssecStatus()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%v", err))
+	}
+
+	return c.JSON(http.StatusOK, status)
+}
+
+func AdminDnssecEnable(c echo.Context) (err error) {
+	err = models.EnableDnssec()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%v", err))
+	}
+
+	return AdminDnssecStatus(c)
+}
+
+func AdminDnssecDS(c echo.Context) (err error) {
+	ds, err := models.GetDnssecDS()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%v", err))
+	}
+
+	return c.JSON(http.StatusOK, map[string][]string{"ds": ds})
+}
+
+func AdminDnssecRollover(c echo.Context) (err error) {
+	r, err := models.StartZskRollover()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%v", err))
+	}
+
+	return c.JSON(http.StatusAccepted, r)
+}
+
+func AdminRateLimit(c echo.Context) (err error) {
+	stats, err := models.GetRateStats()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("%v", err))
+	}
+
+	return c.JSON(http.StatusOK, stats)
+}
+
+// AdminListHosts returns a page of the hosts, filtered by the q parameter
+func AdminListHosts(c echo.Context) (err error) {
+	page, _ := strconv.Atoi(c.QueryParam("page"))
+	perPage, _ := strconv.Atoi(c.QueryParam("per_page"))
+
+	result, err := models.SearchHosts(c.QueryParam("q"), page, perPage)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("%v", err))
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
+// AdminGetHost returns a host with the records published for it
+func AdminGetHost(c echo.Context) (err error) {
+	h, err := models.GetHostByName(c.Param("hostname"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("%v", err))
+	}
+
+	return c.JSON(http.StatusOK, models.NewHostDetails(h, true))
+}
+
+func AdminDeleteHost(c echo.Context) (err error) {
+	err = models.DeleteHost(c.Param("hostname"))
+	if err != nil {
+		return hostError(err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"deleted": c.Param("hostname")})
+}
+
+type AdminAddressesJson struct {
+	IP   string `json:"ip" form:"ip" query:"ip"`
+	IPv6 string `json:"ipv6" form:"ipv6" query:"ipv6"`
+}
+
+func AdminSetHostAddresses(c echo.Context) (err error) {
+	req := &AdminAddressesJson{}
+	if err = c.Bind(req); err != nil {
+		return err
+	}
+
+	return adminHostResult(c, func(hostname string) (*models.Host, error) {
+		return models.SetHostAddresses(hostname, req.IP, req.IPv6)
+	})
+}
+
+func AdminSuspendHost(c echo.Context) (err error) {
+	return adminHostResult(c, models.SuspendHost)
+}
+
+func AdminUnsuspendHost(c echo.Context) (err error) {
+	return adminHostResult(c, models.UnsuspendHost)
+}
+
+func AdminExpireHost(c echo.Context) (err error) {
+	return adminHostResult(c, models.ExpireHost)
+}
+
+// AdminSetHostOwner gives the host to the account of email, the host has no
+// owner anymore if email is empty
+func AdminSetHostOwner(c echo.Context) (err error) {
+	req := &TransferJson{}
+	if err = c.Bind(req); err != nil {
+		return err
+	}
+
+	return adminHostResult(c, func(hostname string) (*models.Host, error) {
+		h, err := models.GetHostByName(hostname)
+		if err != nil {
+			return nil, err
+		}
+		return h, models.SetHostOwner(h, req.Email)
+	})
+}
+
+// AdminListReserved returns the reserved name rules, or only the rule
+// reserving the name parameter if it is set
+func AdminListReserved(c echo.Context) (err error) {
+	if name := c.QueryParam("name"); name != "" {
+		r, err := models.CheckReservedName(name)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("%v", err))
+		}
+
+		rules := []models.ReservedName{}
+		if r != nil {
+			rules = append(rules, *r)
+		}
+		return c.JSON(http.StatusOK, rules)
+	}
+
+	rules, err := models.ListReservedNames()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("%v", err))
+	}
+
+	return c.JSON(http.StatusOK, rules)
+}
+
+func AdminAddReserved(c echo.Context) (err error) {
+	req := &models.ReservedName{}
+	if err = c.Bind(req); err != nil {
+		return err
+	}
+
+	r, err := models.AddReservedName(req.Kind, req.Pattern, req.Reason)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%v", err))
+	}
+
+	return c.JSON(http.StatusCreated, r)
+}
+
+func AdminDeleteReserved(c echo.Context) (err error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid reserved name id")
+	}
+
+	if err = models.DeleteReservedName(id); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("%v", err))
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// adminHostResult runs fn on the host of the request and returns the host
+// with its records
+func adminHostResult(c echo.Context, fn func(hostname string) (*models.Host, error)) error {
+	h, err := fn(c.Param("hostname"))
+	if err != nil {
+		return hostError(err)
+	}
+
+	return c.JSON(http.StatusOK, models.NewHostDetails(h, true))
+}
+
+func hostError(err error) error {
+	if err == models.ErrUnknownHost {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%v", err))
+}
@@ -4,8 +4,11 @@ import (
 	"fmt"
 	"html/template"
 	"io"
+	"net"
 	"net/http"
+	"os"
 	"strconv"
+	"time"
 
 	"github.com/calaos/calaos_dns/config"
 	"github.com/calaos/calaos_dns/models"
@@ -32,6 +35,10 @@ func Init(conffile *string) error {
 		return fmt.Errorf("Failed to read config file: %v", err)
 	}
 
+	if err := initTrustedProxies(); err != nil {
+		return err
+	}
+
 	e = echo.New()
 
 	/*		renderer := &TemplateRenderer{
@@ -42,7 +49,10 @@ func Init(conffile *string) error {
 	*/
 
 	//Middlewares
-	e.Use(middleware.Logger())
+	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
+		Output: &redactWriter{w: os.Stdout},
+	}))
+	e.Use(readSignature)
 	//e.Use(middleware.Recover())
 
 	//CORS
@@ -52,11 +62,42 @@ func Init(conffile *string) error {
 	}))
 
 	//API
-	e.POST("/api/register", RegisterDns)
-	e.GET("/api/update/:token", UpdateDns)
-	e.DELETE("/api/delete/:token", DeleteDns)
-	e.POST("/api/letsencrypt", AddLeRecord)
-	e.DELETE("/api/letsencrypt", DeleteLeRecord)
+	e.POST("/api/register", RegisterDns, rateLimit)
+	e.GET("/api/update", UpdateDns, rateLimit)
+	e.GET("/api/update/:token", UpdateDns, rateLimit)
+	e.DELETE("/api/delete", DeleteDns, rateLimit)
+	e.DELETE("/api/delete/:token", DeleteDns, rateLimit)
+	e.POST("/api/letsencrypt", AddLeRecord, rateLimit)
+	e.DELETE("/api/letsencrypt", DeleteLeRecord, rateLimit)
+	e.GET("/api/letsencrypt/propagation", CheckPropagation, rateLimit)
+	e.POST("/api/certificate", RequestCertificate, rateLimit)
+	e.GET("/api/certificate", GetCertificate)
+	e.GET("/api/certificate/:token", GetCertificate)
+	e.GET("/api/tokens", ListTokens)
+	e.POST("/api/tokens", CreateToken)
+	e.POST("/api/tokens/:id/rotate", RotateToken)
+	e.DELETE("/api/tokens/:id", RevokeToken)
+	e.POST("/api/signing", CreateSigningSecret)
+	e.PUT("/api/signing", SetSignedOnly)
+	e.DELETE("/api/signing", RemoveSigningSecret)
+
+	//DynDNS2 protocol
+	e.GET("/nic/update", DynDnsUpdate, rateLimit)
+
+	//DuckDNS protocol
+	e.GET("/update", DuckDnsUpdate, rateLimit)
+
+	//httpreq DNS provider of lego, Traefik and Caddy
+	e.POST("/httpreq/present", HttpReqPresent, rateLimit)
+	e.POST("/httpreq/cleanup", HttpReqCleanup, rateLimit)
+
+	//acme-dns protocol
+	e.POST("/acmedns/register", AcmeDnsRegister, rateLimit)
+	e.POST("/acmedns/update", AcmeDnsUpdate, rateLimit)
+	e.GET("/acmedns/health", AcmeDnsHealth)
+
+	initAccounts()
+	initAdmin()
 
 	return nil
 }
@@ -69,6 +110,25 @@ type RegisterJson struct {
 	Mainzone string `json:"mainzone" form:"mainzone" query:"mainzone"`
 	Subzones string `json:"subzones" form:"subzones" query:"subzones"`
 	Token    string `json:"token" form:"token" query:"token"`
+	IP       string `json:"ip,omitempty" form:"ip" query:"ip"`
+	IPv6     string `json:"ipv6,omitempty" form:"ipv6" query:"ipv6"`
+}
+
+// requestAddresses returns the addresses given by the client. If none is
+// given, the address of the caller is used for its own family.
+func requestAddresses(c echo.Context, ip, ipv6 string) (string, string) {
+	if ip != "" || ipv6 != "" {
+		return ip, ipv6
+	}
+
+	realIP := net.ParseIP(clientIP(c))
+	if realIP == nil {
+		return "", ""
+	}
+	if realIP.To4() != nil {
+		return realIP.To4().String(), ""
+	}
+	return "", realIP.String()
 }
 
 func RegisterDns(c echo.Context) (err error) {
@@ -76,9 +136,23 @@ func RegisterDns(c echo.Context) (err error) {
 	if err = c.Bind(req); err != nil {
 		return err
 	}
+	req.Token = requestToken(c, req.Token)
 
-	err, t := models.RegisterDns(req.Mainzone, req.Subzones, req.Token, c.RealIP())
-	if err != nil {
+	ip, ipv6 := requestAddresses(c, req.IP, req.IPv6)
+
+	if req.Token != "" {
+		if err = limitToken(c, req.Token); err != nil {
+			return
+		}
+		if _, err = checkSignature(c, req.Token, models.ScopeFull); err != nil {
+			return
+		}
+	}
+
+	err, t := models.RegisterDns(req.Mainzone, req.Subzones, req.Token, ip, ipv6, clientIP(c))
+	if err == models.ErrTooManyHosts {
+		return echo.NewHTTPError(http.StatusTooManyRequests, fmt.Sprintf("%v", err))
+	} else if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%v", err))
 	}
 
@@ -88,9 +162,17 @@ func RegisterDns(c echo.Context) (err error) {
 }
 
 func UpdateDns(c echo.Context) (err error) {
-	token := c.Param("token")
+	token := requestToken(c, c.Param("token"))
+	if err = limitToken(c, token); err != nil {
+		return
+	}
+	h, err := checkSignature(c, token, models.ScopeUpdate)
+	if err != nil {
+		return
+	}
+	ip, ipv6 := requestAddresses(c, c.QueryParam("ip"), c.QueryParam("ipv6"))
 
-	err = models.UpdateDns(token, c.RealIP())
+	err = models.UpdateHostDns(h, ip, ipv6)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%v", err))
 	}
@@ -99,9 +181,16 @@ func UpdateDns(c echo.Context) (err error) {
 }
 
 func DeleteDns(c echo.Context) (err error) {
-	token := c.Param("token")
+	token := requestToken(c, c.Param("token"))
+	if err = limitToken(c, token); err != nil {
+		return
+	}
+	h, err := checkSignature(c, token, models.ScopeFull)
+	if err != nil {
+		return
+	}
 
-	err = models.DeleteDns(token)
+	err = models.DeleteHostDns(h)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%v", err))
 	}
@@ -120,8 +209,16 @@ func AddLeRecord(c echo.Context) (err error) {
 	if err = c.Bind(req); err != nil {
 		return err
 	}
+	req.Token = requestToken(c, req.Token)
+	if err = limitToken(c, req.Token); err != nil {
+		return
+	}
+	h, err := checkSignature(c, req.Token, models.ScopeAcme)
+	if err != nil {
+		return
+	}
 
-	err = models.AddLeRecord(req.Token, req.LeDomain, req.LeToken)
+	err = models.AddHostLeRecord(h, req.LeDomain, req.LeToken)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%v", err))
 	}
@@ -134,11 +231,91 @@ func DeleteLeRecord(c echo.Context) (err error) {
 	if err = c.Bind(req); err != nil {
 		return err
 	}
+	req.Token = requestToken(c, req.Token)
+	if err = limitToken(c, req.Token); err != nil {
+		return
+	}
+	h, err := checkSignature(c, req.Token, models.ScopeAcme)
+	if err != nil {
+		return
+	}
 
-	err = models.DeleteLeRecord(req.Token, req.LeDomain)
+	err = models.DeleteHostLeRecord(h, req.LeDomain, req.LeToken)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%v", err))
 	}
 
 	return c.NoContent(http.StatusOK)
 }
+
+type PropagationJson struct {
+	Token    string `json:"token" form:"token" query:"token"`
+	LeDomain string `json:"le_domain" form:"le_domain" query:"le_domain"`
+	LeToken  string `json:"le_token" form:"le_token" query:"le_token"`
+	Wait     int    `json:"wait" form:"wait" query:"wait"`
+}
+
+// CheckPropagation reports if all authoritative nameservers serve the
+// challenge. With wait, it waits up to wait seconds for the propagation.
+func CheckPropagation(c echo.Context) (err error) {
+	req := &PropagationJson{}
+	if err = c.Bind(req); err != nil {
+		return err
+	}
+	req.Token = requestToken(c, req.Token)
+	h, err := checkSignature(c, req.Token, models.ScopeAcme)
+	if err != nil {
+		return
+	}
+
+	status, err := models.CheckPropagationOf(h, req.LeDomain, req.LeToken, time.Duration(req.Wait)*time.Second)
+	if err == models.ErrTooManyWaits {
+		return echo.NewHTTPError(http.StatusTooManyRequests, fmt.Sprintf("%v", err))
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%v", err))
+	}
+
+	return c.JSON(http.StatusOK, status)
+}
+
+type CertificateJson struct {
+	Token string `json:"token" form:"token" query:"token"`
+}
+
+// RequestCertificate starts the issuance of a certificate for the host and
+// its subzones
+func RequestCertificate(c echo.Context) (err error) {
+	req := &CertificateJson{}
+	if err = bindRequest(c, req); err != nil {
+		return err
+	}
+	req.Token = requestToken(c, req.Token)
+	h, err := checkSignature(c, req.Token, models.ScopeAcme)
+	if err != nil {
+		return
+	}
+
+	err = models.RequestHostCertificate(h)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%v", err))
+	}
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+// GetCertificate returns the certificate and private key of the host
+func GetCertificate(c echo.Context) (err error) {
+	token := requestToken(c, c.Param("token"))
+	h, err := checkSignature(c, token, models.ScopeAcme)
+	if err != nil {
+		return
+	}
+
+	bundle, err := models.GetHostCertificate(h)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("%v", err))
+	}
+
+	return c.JSON(http.StatusOK, bundle)
+}
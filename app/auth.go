@@ -0,0 +1,63 @@
+package app
+
+import (
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/calaos/calaos_dns/utils"
+
+	"github.com/labstack/echo"
+)
+
+// requestToken returns the token of the request. A token sent in the
+// Authorization header, either as a Bearer token or as the password of a
+// Basic auth, takes precedence over the token passed in the URL or the body.
+func requestToken(c echo.Context, token string) string {
+	auth := c.Request().Header.Get(echo.HeaderAuthorization)
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+
+	if _, password, ok := c.Request().BasicAuth(); ok && password != "" {
+		return password
+	}
+
+	return token
+}
+
+// bindRequest binds the parameters of the request to req. Unlike c.Bind, a
+// POST or PUT request without body is accepted since its token can be in the
+// Authorization header.
+func bindRequest(c echo.Context, req interface{}) error {
+	r := c.Request()
+	if r.ContentLength == 0 && r.Method != echo.GET && r.Method != echo.DELETE {
+		return nil
+	}
+	return c.Bind(req)
+}
+
+// Tokens passed in the path of these endpoints or as a token parameter
+var tokenInURL = regexp.MustCompile(`(/api/(?:update|delete|certificate)/|[?&]token=)([^/?&"\s]+)`)
+
+// redactTokens replaces the tokens found in URLs of line by their redacted
+// form
+func redactTokens(line []byte) []byte {
+	return tokenInURL.ReplaceAllFunc(line, func(m []byte) []byte {
+		sub := tokenInURL.FindSubmatch(m)
+		r := append([]byte{}, sub[1]...)
+		return append(r, utils.RedactToken(string(sub[2]))...)
+	})
+}
+
+// redactWriter redacts the tokens of the access log before writing it
+type redactWriter struct {
+	w io.Writer
+}
+
+func (r *redactWriter) Write(p []byte) (n int, err error) {
+	if _, err = r.w.Write(redactTokens(p)); err != nil {
+		return
+	}
+	return len(p), nil
+}
@@ -0,0 +1,79 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/calaos/calaos_dns/config"
+
+	"github.com/labstack/echo"
+)
+
+var trustedProxies []*net.IPNet
+
+// initTrustedProxies parses the trusted proxies of the config file
+func initTrustedProxies() error {
+	trustedProxies = nil
+	for _, p := range config.Conf.General.TrustedProxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return fmt.Errorf("Invalid trusted proxy %v: %v", p, err)
+		}
+		trustedProxies = append(trustedProxies, n)
+	}
+	return nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client of the request. The proxy
+// headers are only read when the peer is a trusted proxy, and the address
+// given by X-Forwarded-For is the last one not added by a trusted proxy.
+func clientIP(c echo.Context) string {
+	r := c.Request()
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(peer)
+	if ip == nil || !isTrustedProxy(ip) {
+		return peer
+	}
+
+	if xff := r.Header.Get(echo.HeaderXForwardedFor); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				break
+			}
+			if i == 0 || !isTrustedProxy(hop) {
+				return hop.String()
+			}
+		}
+		return peer
+	}
+
+	if xri := net.ParseIP(strings.TrimSpace(r.Header.Get(echo.HeaderXRealIP))); xri != nil {
+		return xri.String()
+	}
+
+	return peer
+}
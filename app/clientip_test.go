@@ -0,0 +1,62 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/calaos/calaos_dns/config"
+
+	"github.com/labstack/echo"
+)
+
+func TestClientIP(t *testing.T) {
+	config.Conf.General.TrustedProxies = []string{"10.0.0.1", "192.168.0.0/16"}
+	defer func() { config.Conf.General.TrustedProxies = nil }()
+	if err := initTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		peer string
+		xff  string
+		xri  string
+		want string
+	}{
+		{"1.2.3.4:1000", "", "", "1.2.3.4"},
+		{"1.2.3.4:1000", "5.6.7.8", "", "1.2.3.4"},
+		{"1.2.3.4:1000", "", "5.6.7.8", "1.2.3.4"},
+		{"10.0.0.1:1000", "5.6.7.8", "", "5.6.7.8"},
+		{"10.0.0.1:1000", "", "5.6.7.8", "5.6.7.8"},
+		{"10.0.0.1:1000", "9.9.9.9, 5.6.7.8", "", "5.6.7.8"},
+		{"10.0.0.1:1000", "9.9.9.9, 5.6.7.8, 192.168.1.1", "", "5.6.7.8"},
+		{"10.0.0.1:1000", "192.168.1.1", "", "192.168.1.1"},
+		{"10.0.0.1:1000", "garbage", "", "10.0.0.1"},
+		{"[2001:db8::1]:1000", "5.6.7.8", "", "2001:db8::1"},
+	}
+
+	e := echo.New()
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.peer
+		if tt.xff != "" {
+			req.Header.Set(echo.HeaderXForwardedFor, tt.xff)
+		}
+		if tt.xri != "" {
+			req.Header.Set(echo.HeaderXRealIP, tt.xri)
+		}
+
+		c := e.NewContext(req, httptest.NewRecorder())
+		if got := clientIP(c); got != tt.want {
+			t.Errorf("clientIP(%v, xff=%q, xri=%q) = %v, want %v", tt.peer, tt.xff, tt.xri, got, tt.want)
+		}
+	}
+}
+
+func TestInitTrustedProxiesInvalid(t *testing.T) {
+	config.Conf.General.TrustedProxies = []string{"not-an-ip"}
+	defer func() { config.Conf.General.TrustedProxies = nil }()
+	if err := initTrustedProxies(); err == nil {
+		t.Error("invalid trusted proxy accepted")
+	}
+}
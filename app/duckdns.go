@@ -0,0 +1,125 @@
+package app
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/calaos/calaos_dns/config"
+	"github.com/calaos/calaos_dns/models"
+	"github.com/calaos/calaos_dns/utils"
+
+	"github.com/labstack/echo"
+)
+
+type DuckDnsQuery struct {
+	Domains string `query:"domains"`
+	Token   string `query:"token"`
+	IP      string `query:"ip"`
+	IPv6    string `query:"ipv6"`
+	Txt     string `query:"txt"`
+	Clear   bool   `query:"clear"`
+	Verbose bool   `query:"verbose"`
+}
+
+// DuckDnsUpdate implements the DuckDNS update API. It either updates the
+// addresses of the host or its _acme-challenge TXT records when txt is given.
+func DuckDnsUpdate(c echo.Context) (err error) {
+	req := &DuckDnsQuery{}
+	if err = c.Bind(req); err != nil {
+		return c.String(http.StatusOK, "KO")
+	}
+	req.Token = requestToken(c, req.Token)
+	if err = limitToken(c, req.Token); err != nil {
+		return
+	}
+
+	//The token only needs the scope of the requested operation
+	_, hasTxt := c.QueryParams()["txt"]
+	scope := models.ScopeUpdate
+	if hasTxt {
+		scope = models.ScopeAcme
+	}
+
+	h, err := verifySignature(c, req.Token, scope)
+	if err != nil {
+		//The protocol has no error message, only the log tells why
+		log.Println("DuckDNS update refused for token", utils.RedactToken(req.Token), ":", err)
+		return c.String(http.StatusOK, "KO")
+	}
+
+	var domains []string
+	for _, d := range strings.Split(req.Domains, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+
+		leDomain, ok := duckDomain(h, d)
+		if !ok {
+			return c.String(http.StatusOK, "KO")
+		}
+		domains = append(domains, leDomain)
+	}
+
+	if len(domains) == 0 {
+		return c.String(http.StatusOK, "KO")
+	}
+
+	//Letsencrypt DNS challenge
+	if hasTxt {
+		for _, d := range domains {
+			if req.Clear || req.Txt == "" {
+				err = models.DeleteHostLeRecord(h, d, "")
+			} else {
+				err = models.AddHostLeRecord(h, d, req.Txt)
+			}
+			if err != nil {
+				return c.String(http.StatusOK, "KO")
+			}
+		}
+
+		if req.Verbose {
+			return c.String(http.StatusOK, "OK\n"+req.Txt+"\nUPDATED")
+		}
+		return c.String(http.StatusOK, "OK")
+	}
+
+	status := "NOCHANGE"
+	ip, ipv6 := "", ""
+	if req.Clear {
+		if err = models.ClearHostDns(h); err != nil {
+			return c.String(http.StatusOK, "KO")
+		}
+		status = "UPDATED"
+	} else {
+		ip, ipv6 = requestAddresses(c, req.IP, req.IPv6)
+		if (ip != "" && ip != h.IP) || (ipv6 != "" && ipv6 != h.IPv6) {
+			status = "UPDATED"
+		}
+
+		//Always update, even without change, to refresh the expiration of the host
+		if err = models.UpdateHostDns(h, ip, ipv6); err != nil {
+			return c.String(http.StatusOK, "KO")
+		}
+	}
+
+	if req.Verbose {
+		return c.String(http.StatusOK, "OK\n"+ip+"\n"+ipv6+"\n"+status)
+	}
+	return c.String(http.StatusOK, "OK")
+}
+
+// duckDomain converts a domain of a DuckDNS request (mainzone, subzone or
+// their full name) to the domain name used by the letsencrypt functions
+func duckDomain(h *models.Host, d string) (string, bool) {
+	d = strings.TrimSuffix(strings.ToLower(d), ".")
+	d = strings.TrimSuffix(d, "."+config.Conf.Powerdns.Zone)
+	d = strings.TrimSuffix(d, "."+h.Hostname)
+
+	if d == h.Hostname || utils.StringInSlice(d, strings.Split(h.Subzones, ",")) {
+		return d, true
+	}
+
+	return "", false
+}
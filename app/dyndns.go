@@ -0,0 +1,135 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/calaos/calaos_dns/config"
+	"github.com/calaos/calaos_dns/models"
+	"github.com/calaos/calaos_dns/utils"
+
+	"github.com/labstack/echo"
+)
+
+// Return codes of the dyndns2 protocol
+const (
+	dynGood     = "good"
+	dynNoChg    = "nochg"
+	dynBadAuth  = "badauth"
+	dynNotFqdn  = "notfqdn"
+	dynNoHost   = "nohost"
+	dynDnsErr   = "dnserr"
+	dynAbuse    = "abuse"
+	dynSrvError = "911"
+)
+
+// DynDnsUpdate implements the dyndns2 update protocol used by most routers.
+// The user is the mainzone of the host and the password its token.
+func DynDnsUpdate(c echo.Context) (err error) {
+	user, token, ok := c.Request().BasicAuth()
+	if !ok {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="calaos_dns"`)
+		return c.String(http.StatusUnauthorized, dynBadAuth)
+	}
+
+	if ok, _ := models.AllowRequest(models.LimitToken, token); !ok {
+		return c.String(http.StatusOK, dynAbuse)
+	}
+	h, err := basicAuthHost(c, user, token, models.ScopeUpdate)
+	if err == models.ErrHostSuspended {
+		return c.String(http.StatusOK, dynAbuse)
+	} else if err != nil {
+		return c.String(http.StatusOK, dynBadAuth)
+	}
+
+	var hostnames []string
+	for _, n := range strings.Split(c.QueryParam("hostname"), ",") {
+		n = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(n)), ".")
+		if n == "" {
+			continue
+		}
+
+		if !strings.HasSuffix(n, "."+config.Conf.Powerdns.Zone) {
+			return c.String(http.StatusOK, dynNotFqdn)
+		}
+		if !utils.StringInSlice(n, h.Zones()) {
+			return c.String(http.StatusOK, dynNoHost)
+		}
+
+		hostnames = append(hostnames, n)
+	}
+
+	if len(hostnames) == 0 {
+		return c.String(http.StatusOK, dynNotFqdn)
+	}
+
+	ip, ipv6, valid := dynAddresses(c.QueryParam("myip"), c.QueryParam("myipv6"))
+	if !valid {
+		return c.String(http.StatusOK, dynDnsErr)
+	}
+	ip, ipv6 = requestAddresses(c, ip, ipv6)
+
+	var addrs []string
+	for _, a := range []string{ip, ipv6} {
+		if a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+
+	code := dynNoChg
+	if (ip != "" && ip != h.IP) || (ipv6 != "" && ipv6 != h.IPv6) {
+		code = dynGood
+	}
+
+	//Always update, even without change, to refresh the expiration of the host
+	if err = models.UpdateHostDns(h, ip, ipv6); err != nil {
+		return c.String(http.StatusOK, dynSrvError)
+	}
+
+	//One answer line for each hostname of the request
+	reply := make([]string, len(hostnames))
+	for i := range hostnames {
+		reply[i] = code + " " + strings.Join(addrs, ",")
+	}
+
+	return c.String(http.StatusOK, strings.Join(reply, "\n"))
+}
+
+// basicAuthHost returns the host of a Basic auth where the user is the
+// mainzone of the host or its full name and the password a token allowed for
+// scope. The signature of the request is checked too.
+func basicAuthHost(c echo.Context, user, token, scope string) (h *models.Host, err error) {
+	h, err = verifySignature(c, token, scope)
+	if err != nil {
+		return
+	}
+
+	user = strings.TrimSuffix(strings.ToLower(user), ".")
+	if user != h.Hostname && user != h.Zones()[0] {
+		return nil, fmt.Errorf("Unknown token")
+	}
+
+	return
+}
+
+// dynAddresses splits the comma separated myip list of a dyndns2 request
+// into its IPv4 and IPv6 addresses
+func dynAddresses(myip, myipv6 string) (ip, ipv6 string, valid bool) {
+	for _, a := range strings.Split(myip+","+myipv6, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+
+		if v4, ok := utils.IsValidIPv4(a); ok {
+			ip = v4
+		} else if v6, ok := utils.IsValidIPv6(a); ok {
+			ipv6 = v6
+		} else {
+			return "", "", false
+		}
+	}
+
+	return ip, ipv6, true
+}
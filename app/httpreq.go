@@ -0,0 +1,77 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/calaos/calaos_dns/models"
+
+	"github.com/go-acme/lego/challenge/dns01"
+	"github.com/labstack/echo"
+)
+
+// HttpReqJson is the body of the requests of the lego httpreq DNS provider.
+// Fqdn and Value are sent by default, Domain, Token and KeyAuth in RAW mode.
+type HttpReqJson struct {
+	Fqdn    string `json:"fqdn"`
+	Value   string `json:"value"`
+	Domain  string `json:"domain"`
+	Token   string `json:"token"`
+	KeyAuth string `json:"keyAuth"`
+}
+
+// HttpReqPresent publishes a challenge for the httpreq DNS provider of lego,
+// Traefik and Caddy. The user is the mainzone of the host and the password
+// its token.
+func HttpReqPresent(c echo.Context) (err error) {
+	return httpReq(c, models.AddHostLeRecord)
+}
+
+// HttpReqCleanup removes a challenge published by HttpReqPresent
+func HttpReqCleanup(c echo.Context) (err error) {
+	return httpReq(c, models.DeleteHostLeRecord)
+}
+
+func httpReq(c echo.Context, fn func(h *models.Host, leDomain, leToken string) error) (err error) {
+	user, token, ok := c.Request().BasicAuth()
+	if !ok {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="calaos_dns"`)
+		return echo.NewHTTPError(http.StatusUnauthorized)
+	}
+
+	if err = limitToken(c, token); err != nil {
+		return
+	}
+	h, err := basicAuthHost(c, user, token, models.ScopeAcme)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, fmt.Sprintf("%v", err))
+	}
+
+	req := &HttpReqJson{}
+	if err = c.Bind(req); err != nil {
+		return err
+	}
+
+	fqdn, value := req.Fqdn, req.Value
+	if req.Domain != "" { //RAW mode
+		fqdn, value = dns01.GetRecord(req.Domain, req.KeyAuth)
+	}
+
+	name := strings.TrimSuffix(strings.ToLower(fqdn), ".")
+	if !strings.HasPrefix(name, "_acme-challenge.") || value == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Bad input")
+	}
+
+	leDomain, ok := duckDomain(h, strings.TrimPrefix(name, "_acme-challenge."))
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "Wrong domain")
+	}
+
+	err = fn(h, leDomain, value)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%v", err))
+	}
+
+	return c.NoContent(http.StatusOK)
+}
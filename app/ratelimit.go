@@ -0,0 +1,35 @@
+package app
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/calaos/calaos_dns/models"
+
+	"github.com/labstack/echo"
+)
+
+// rateLimit refuses the requests of a source IP over its rate limit
+func rateLimit(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if ok, retry := models.AllowRequest(models.LimitIP, clientIP(c)); !ok {
+			return tooManyRequests(c, retry)
+		}
+		return next(c)
+	}
+}
+
+// limitToken returns an error if token is over its rate limit
+func limitToken(c echo.Context, token string) error {
+	if ok, retry := models.AllowRequest(models.LimitToken, token); !ok {
+		return tooManyRequests(c, retry)
+	}
+	return nil
+}
+
+func tooManyRequests(c echo.Context, retry time.Duration) error {
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	return echo.NewHTTPError(http.StatusTooManyRequests, "Too many requests")
+}
@@ -0,0 +1,144 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/calaos/calaos_dns/models"
+
+	"github.com/labstack/echo"
+)
+
+// Headers of a signed request
+const (
+	HeaderTimestamp = "X-Calaos-Timestamp"
+	HeaderNonce     = "X-Calaos-Nonce"
+	HeaderSignature = "X-Calaos-Signature"
+)
+
+// Maximum size of the body of a signed request
+const maxSignedBody = 1 << 20
+
+// readSignature keeps the signature of a signed request for verifySignature.
+// The body is read to be signed and given back to the handler.
+func readSignature(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		r := c.Request()
+		signature := r.Header.Get(HeaderSignature)
+		if signature == "" {
+			return next(c)
+		}
+
+		var body []byte
+		if r.Body != nil {
+			var err error
+			body, err = ioutil.ReadAll(io.LimitReader(r.Body, maxSignedBody))
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "Unable to read request")
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		c.Set("signature", &models.RequestSignature{
+			Method:    r.Method,
+			URI:       r.URL.RequestURI(),
+			Body:      body,
+			Timestamp: r.Header.Get(HeaderTimestamp),
+			Nonce:     r.Header.Get(HeaderNonce),
+			Signature: signature,
+		})
+
+		return next(c)
+	}
+}
+
+// verifySignature checks the signature of a request made with token and
+// returns the host of the token if it is allowed for scope. Unsigned requests
+// are only accepted if the host is not signed only.
+func verifySignature(c echo.Context, token, scope string) (*models.Host, error) {
+	sig, _ := c.Get("signature").(*models.RequestSignature)
+	return models.VerifyRequest(token, scope, sig)
+}
+
+// checkSignature is verifySignature for the API endpoints
+func checkSignature(c echo.Context, token, scope string) (*models.Host, error) {
+	h, err := verifySignature(c, token, scope)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, fmt.Sprintf("%v", err))
+	}
+	return h, nil
+}
+
+type SigningJson struct {
+	Token      string `json:"token,omitempty" form:"token" query:"token"`
+	SignedOnly bool   `json:"signed_only" form:"signed_only" query:"signed_only"`
+	Secret     string `json:"secret,omitempty"`
+}
+
+// CreateSigningSecret generates the signing secret of the host. The secret
+// is only sent once.
+func CreateSigningSecret(c echo.Context) (err error) {
+	req := &SigningJson{}
+	if err = bindRequest(c, req); err != nil {
+		return err
+	}
+	req.Token = requestToken(c, req.Token)
+
+	h, err := tokenHost(c, req.Token)
+	if err != nil {
+		return
+	}
+
+	secret, err := models.CreateSigningSecret(h)
+	if err == models.ErrSigningDisabled {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%v", err))
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("%v", err))
+	}
+
+	return c.JSON(http.StatusCreated, &SigningJson{Secret: secret, SignedOnly: h.SignedOnly})
+}
+
+// SetSignedOnly switches the host to signed only requests, or back
+func SetSignedOnly(c echo.Context) (err error) {
+	req := &SigningJson{}
+	if err = bindRequest(c, req); err != nil {
+		return err
+	}
+	req.Token = requestToken(c, req.Token)
+
+	h, err := tokenHost(c, req.Token)
+	if err != nil {
+		return
+	}
+
+	if err = models.SetSignedOnly(h, req.SignedOnly); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%v", err))
+	}
+
+	return c.JSON(http.StatusOK, &SigningJson{SignedOnly: h.SignedOnly})
+}
+
+// RemoveSigningSecret removes the signing secret of the host
+func RemoveSigningSecret(c echo.Context) (err error) {
+	req := &SigningJson{}
+	if err = bindRequest(c, req); err != nil {
+		return err
+	}
+	req.Token = requestToken(c, req.Token)
+
+	h, err := tokenHost(c, req.Token)
+	if err != nil {
+		return
+	}
+
+	if err = models.RemoveSigningSecret(h); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("%v", err))
+	}
+
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,137 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/calaos/calaos_dns/models"
+
+	"github.com/labstack/echo"
+)
+
+type TokenJson struct {
+	Token string `json:"token" form:"token" query:"token"`
+	Label string `json:"label" form:"label" query:"label"`
+	Scope string `json:"scope" form:"scope" query:"scope"`
+}
+
+// NewTokenJson is a token that has just been generated. The token is only
+// sent once, it can't be read again later.
+type NewTokenJson struct {
+	models.Token
+	Value string `json:"token"`
+}
+
+// tokenHost returns the host of the full token of the request
+func tokenHost(c echo.Context, token string) (*models.Host, error) {
+	return checkSignature(c, token, models.ScopeFull)
+}
+
+func tokenID(c echo.Context) (int64, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "Invalid token id")
+	}
+	return id, nil
+}
+
+// ListTokens returns the tokens of the host
+func ListTokens(c echo.Context) (err error) {
+	req := &TokenJson{}
+	if err = bindRequest(c, req); err != nil {
+		return err
+	}
+	req.Token = requestToken(c, req.Token)
+
+	h, err := tokenHost(c, req.Token)
+	if err != nil {
+		return
+	}
+
+	tokens, err := models.ListTokens(h)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Internal error")
+	}
+	if tokens == nil {
+		tokens = []models.Token{}
+	}
+
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// CreateToken adds a token to the host, with the full scope if none is given
+func CreateToken(c echo.Context) (err error) {
+	req := &TokenJson{}
+	if err = bindRequest(c, req); err != nil {
+		return err
+	}
+	req.Token = requestToken(c, req.Token)
+
+	h, err := tokenHost(c, req.Token)
+	if err != nil {
+		return
+	}
+
+	if req.Scope == "" {
+		req.Scope = models.ScopeFull
+	}
+
+	token, t, err := models.CreateToken(h, req.Label, req.Scope)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%v", err))
+	}
+
+	return c.JSON(http.StatusCreated, &NewTokenJson{Token: *t, Value: token})
+}
+
+// RotateToken replaces a token of the host by a new one
+func RotateToken(c echo.Context) (err error) {
+	req := &TokenJson{}
+	if err = bindRequest(c, req); err != nil {
+		return err
+	}
+	req.Token = requestToken(c, req.Token)
+
+	h, err := tokenHost(c, req.Token)
+	if err != nil {
+		return
+	}
+
+	id, err := tokenID(c)
+	if err != nil {
+		return
+	}
+
+	token, t, err := models.RotateToken(h, id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%v", err))
+	}
+
+	return c.JSON(http.StatusCreated, &NewTokenJson{Token: *t, Value: token})
+}
+
+// RevokeToken revokes a token of the host
+func RevokeToken(c echo.Context) (err error) {
+	req := &TokenJson{}
+	if err = bindRequest(c, req); err != nil {
+		return err
+	}
+	req.Token = requestToken(c, req.Token)
+
+	h, err := tokenHost(c, req.Token)
+	if err != nil {
+		return
+	}
+
+	id, err := tokenID(c)
+	if err != nil {
+		return
+	}
+
+	if err = models.RevokeToken(h, id); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%v", err))
+	}
+
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,146 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/calaos/calaos_dns/config"
+)
+
+// RRType is the type of a resource record
+type RRType string
+
+const (
+	TypeA    RRType = "A"
+	TypeAAAA RRType = "AAAA"
+	TypeTXT  RRType = "TXT"
+	TypeSOA  RRType = "SOA"
+	TypeNS   RRType = "NS"
+)
+
+// Record is a RRset of the managed zone. Name is the full name of the
+// record without the trailing dot and Content holds the data of each
+// record in zone file format (TXT strings are quoted).
+type Record struct {
+	Name    string
+	Type    RRType
+	TTL     uint32
+	Content []string
+}
+
+// Zone is the managed zone with all its RRsets
+type Zone struct {
+	Name    string
+	Serial  uint32
+	Records []Record
+}
+
+// Change is a modification of a RRset. The RRset is replaced by the
+// record unless Delete is set.
+type Change struct {
+	Record
+	Delete bool
+}
+
+// Upsert returns the change creating or replacing a RRset
+func Upsert(name string, rrtype RRType, ttl uint32, content []string) Change {
+	return Change{Record: Record{Name: name, Type: rrtype, TTL: ttl, Content: content}}
+}
+
+// Delete returns the change removing a RRset
+func Delete(name string, rrtype RRType) Change {
+	return Change{Record: Record{Name: name, Type: rrtype}, Delete: true}
+}
+
+// Backend is a DNS provider publishing the records of the managed zone
+type Backend interface {
+	// Apply applies all changes at once. Either all of them are applied or
+	// none if an error is returned.
+	Apply(ctx context.Context, changes []Change) error
+
+	// UpsertRRset creates or replaces the RRset of name and type
+	UpsertRRset(ctx context.Context, name string, rrtype RRType, ttl uint32, content []string) error
+
+	// DeleteRRset removes the RRset of name and type if it exists
+	DeleteRRset(ctx context.Context, name string, rrtype RRType) error
+
+	// ListRecords returns all RRsets of name
+	ListRecords(ctx context.Context, name string) ([]Record, error)
+
+	// GetZone returns the managed zone
+	GetZone(ctx context.Context) (*Zone, error)
+
+	// Notify makes sure the serial of the zone has been increased after a
+	// change and tells the secondaries to refresh the zone
+	Notify(ctx context.Context) error
+
+	// Check verifies the settings of the zone. It returns a warning for
+	// each setting preventing changes to propagate quickly.
+	Check(ctx context.Context) (warnings []string, err error)
+}
+
+// Key is a DNSSEC signing key of the zone
+type Key struct {
+	ID        uint64   `json:"id"`
+	Type      string   `json:"type"`
+	Active    bool     `json:"active"`
+	Published bool     `json:"published"`
+	Algorithm string   `json:"algorithm"`
+	Bits      int      `json:"bits"`
+	DNSKEY    string   `json:"dnskey"`
+	DS        []string `json:"ds,omitempty"`
+}
+
+// Types of DNSSEC keys
+const (
+	KeyKSK = "ksk"
+	KeyZSK = "zsk"
+	KeyCSK = "csk"
+)
+
+// DNSSEC is implemented by backends managing the signing keys of the zone
+type DNSSEC interface {
+	// EnableDNSSEC creates the signing keys of the zone and makes sure the
+	// zone is rectified after each change
+	EnableDNSSEC(ctx context.Context) error
+
+	// ListKeys returns all the keys of the zone
+	ListKeys(ctx context.Context) ([]Key, error)
+
+	// AddKey creates a new published key
+	AddKey(ctx context.Context, keyType string, active bool) (*Key, error)
+
+	// SetKeyActive starts or stops signing the zone with a key, the key
+	// stays published
+	SetKeyActive(ctx context.Context, id uint64, active bool) error
+
+	// DeleteKey removes a key from the zone
+	DeleteKey(ctx context.Context, id uint64) error
+}
+
+// New creates the backend selected in the config file
+func New() (Backend, error) {
+	zone := config.Conf.Powerdns.Zone
+
+	switch config.Conf.Backend.Type {
+	case "", "powerdns":
+		return NewPowerDNS(config.Conf.Powerdns.Api, config.Conf.Powerdns.ApiKey, zone), nil
+	case "memory":
+		return NewMemory(zone), nil
+	case "rfc2136":
+		c := config.Conf.Rfc2136
+		return NewRFC2136(c.Server, zone, c.KeyName, c.Algorithm, c.Secret), nil
+	}
+
+	return nil, fmt.Errorf("Unknown DNS backend: %v", config.Conf.Backend.Type)
+}
+
+// CanonicalName returns name in lower case without its trailing dot
+func CanonicalName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+func (r Record) String() string {
+	return fmt.Sprintf("%v\t%v\t%v\t%v", r.Name, r.Type, r.TTL, strings.Join(r.Content, " "))
+}
@@ -0,0 +1,192 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Memory keeps the records in memory. It is meant for tests and for
+// installs without an external DNS server. DNSSEC keys are only tracked,
+// the zone is not signed.
+type Memory struct {
+	lock    sync.RWMutex
+	zone    string
+	serial  uint32
+	records map[memoryKey]Record
+	keys    []Key
+	lastKey uint64
+}
+
+type memoryKey struct {
+	name   string
+	rrtype RRType
+}
+
+func NewMemory(zone string) *Memory {
+	return &Memory{
+		zone:    CanonicalName(zone),
+		serial:  1,
+		records: make(map[memoryKey]Record),
+	}
+}
+
+func (m *Memory) Apply(ctx context.Context, changes []Change) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, c := range changes {
+		key := memoryKey{CanonicalName(c.Name), c.Type}
+		if c.Delete {
+			delete(m.records, key)
+			continue
+		}
+
+		m.records[key] = Record{
+			Name:    key.name,
+			Type:    c.Type,
+			TTL:     c.TTL,
+			Content: append([]string(nil), c.Content...),
+		}
+	}
+	m.serial++
+
+	return nil
+}
+
+func (m *Memory) UpsertRRset(ctx context.Context, name string, rrtype RRType, ttl uint32, content []string) error {
+	return m.Apply(ctx, []Change{Upsert(name, rrtype, ttl, content)})
+}
+
+func (m *Memory) DeleteRRset(ctx context.Context, name string, rrtype RRType) error {
+	return m.Apply(ctx, []Change{Delete(name, rrtype)})
+}
+
+func (m *Memory) ListRecords(ctx context.Context, name string) (records []Record, err error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	name = CanonicalName(name)
+	for k, r := range m.records {
+		if k.name == name {
+			records = append(records, r)
+		}
+	}
+	sortRecords(records)
+
+	return
+}
+
+func (m *Memory) GetZone(ctx context.Context) (*Zone, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	zone := &Zone{
+		Name:   m.zone,
+		Serial: m.serial,
+	}
+	for _, r := range m.records {
+		zone.Records = append(zone.Records, r)
+	}
+	sortRecords(zone.Records)
+
+	return zone, nil
+}
+
+func sortRecords(records []Record) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Name != records[j].Name {
+			return records[i].Name < records[j].Name
+		}
+		return records[i].Type < records[j].Type
+	})
+}
+
+func (m *Memory) Notify(ctx context.Context) error {
+	return nil
+}
+
+func (m *Memory) Check(ctx context.Context) ([]string, error) {
+	return nil, nil
+}
+
+func (m *Memory) EnableDNSSEC(ctx context.Context) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	hasKey := make(map[string]bool)
+	for _, k := range m.keys {
+		if k.Active {
+			hasKey[k.Type] = true
+		}
+	}
+
+	if !hasKey[KeyKSK] && !hasKey[KeyCSK] {
+		m.addKey(KeyKSK, true)
+	}
+	if !hasKey[KeyZSK] && !hasKey[KeyCSK] {
+		m.addKey(KeyZSK, true)
+	}
+
+	return nil
+}
+
+func (m *Memory) ListKeys(ctx context.Context) ([]Key, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return append([]Key(nil), m.keys...), nil
+}
+
+func (m *Memory) AddKey(ctx context.Context, keyType string, active bool) (*Key, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	k := m.addKey(keyType, active)
+	return &k, nil
+}
+
+func (m *Memory) addKey(keyType string, active bool) Key {
+	m.lastKey++
+	k := Key{
+		ID:        m.lastKey,
+		Type:      keyType,
+		Active:    active,
+		Published: true,
+		Algorithm: "ECDSAP256SHA256",
+		Bits:      256,
+	}
+	m.keys = append(m.keys, k)
+	m.serial++
+
+	return k
+}
+
+func (m *Memory) SetKeyActive(ctx context.Context, id uint64, active bool) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for i := range m.keys {
+		if m.keys[i].ID == id {
+			m.keys[i].Active = active
+			m.serial++
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown key %d", id)
+}
+
+func (m *Memory) DeleteKey(ctx context.Context, id uint64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for i := range m.keys {
+		if m.keys[i].ID == id {
+			m.keys = append(m.keys[:i], m.keys[i+1:]...)
+			m.serial++
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown key %d", id)
+}
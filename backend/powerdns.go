@@ -0,0 +1,392 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/joeig/go-powerdns/v3"
+)
+
+// PowerDNS publishes records through the PowerDNS HTTP API
+type PowerDNS struct {
+	client *powerdns.Client
+	api    string
+	apiKey string
+	zone   string
+
+	//zone settings found by Check
+	lock       sync.Mutex
+	checked    bool
+	bumpSerial bool
+	notify     bool
+	rectify    bool
+}
+
+func NewPowerDNS(api, apiKey, zone string) *PowerDNS {
+	headers := make(map[string]string)
+	headers["X-API-Key"] = apiKey
+
+	return &PowerDNS{
+		client: powerdns.NewClient(api, "localhost", headers, nil),
+		api:    strings.TrimSuffix(api, "/"),
+		apiKey: apiKey,
+		zone:   zone,
+	}
+}
+
+// Client returns the underlying PowerDNS API client
+func (p *PowerDNS) Client() *powerdns.Client {
+	return p.client
+}
+
+// Apply sends all changes in a single PATCH of the zone, which PowerDNS
+// applies in one transaction
+func (p *PowerDNS) Apply(ctx context.Context, changes []Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	rrsets := &powerdns.RRsets{}
+	for _, c := range changes {
+		rr := powerdns.RRset{
+			Name:    powerdns.String(CanonicalName(c.Name) + "."),
+			Type:    powerdns.RRTypePtr(powerdns.RRType(c.Type)),
+			Records: []powerdns.Record{},
+		}
+
+		if c.Delete {
+			rr.ChangeType = powerdns.ChangeTypePtr(powerdns.ChangeTypeDelete)
+		} else {
+			rr.ChangeType = powerdns.ChangeTypePtr(powerdns.ChangeTypeReplace)
+			rr.TTL = powerdns.Uint32(c.TTL)
+			for _, content := range c.Content {
+				rr.Records = append(rr.Records, powerdns.Record{
+					Content:  powerdns.String(content),
+					Disabled: powerdns.Bool(false),
+					SetPTR:   powerdns.Bool(false),
+				})
+			}
+		}
+
+		rrsets.Sets = append(rrsets.Sets, rr)
+	}
+
+	return p.client.Records.Patch(ctx, p.zone, rrsets)
+}
+
+func (p *PowerDNS) UpsertRRset(ctx context.Context, name string, rrtype RRType, ttl uint32, content []string) error {
+	return p.client.Records.Change(ctx, p.zone, name, powerdns.RRType(rrtype), ttl, content)
+}
+
+func (p *PowerDNS) DeleteRRset(ctx context.Context, name string, rrtype RRType) error {
+	return p.client.Records.Delete(ctx, p.zone, name, powerdns.RRType(rrtype))
+}
+
+func (p *PowerDNS) ListRecords(ctx context.Context, name string) (records []Record, err error) {
+	rrsets, err := p.client.Records.Get(ctx, p.zone, name+".", nil)
+	if err != nil {
+		return
+	}
+
+	//Older PowerDNS versions ignore the rrset_name filter
+	name = CanonicalName(name)
+	for i := range rrsets {
+		r := fromRRset(&rrsets[i])
+		if r.Name == name {
+			records = append(records, r)
+		}
+	}
+
+	return
+}
+
+func (p *PowerDNS) GetZone(ctx context.Context) (*Zone, error) {
+	z, err := p.client.Zones.Get(ctx, p.zone)
+	if err != nil {
+		return nil, err
+	}
+
+	zone := &Zone{
+		Name:   CanonicalName(powerdns.StringValue(z.Name)),
+		Serial: powerdns.Uint32Value(z.Serial),
+	}
+	for i := range z.RRsets {
+		zone.Records = append(zone.Records, fromRRset(&z.RRsets[i]))
+	}
+
+	return zone, nil
+}
+
+func fromRRset(rr *powerdns.RRset) (r Record) {
+	r.Name = CanonicalName(powerdns.StringValue(rr.Name))
+	if rr.Type != nil {
+		r.Type = RRType(*rr.Type)
+	}
+	r.TTL = powerdns.Uint32Value(rr.TTL)
+	for _, rec := range rr.Records {
+		r.Content = append(r.Content, powerdns.StringValue(rec.Content))
+	}
+
+	return
+}
+
+// Notify increases the serial itself when soa_edit_api is disabled on the
+// zone, and asks PowerDNS to notify the secondaries of a master zone
+func (p *PowerDNS) Notify(ctx context.Context) (err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.checked {
+		if _, err = p.check(ctx); err != nil {
+			return
+		}
+	}
+
+	if p.bumpSerial {
+		if err = p.increaseSerial(ctx); err != nil {
+			return fmt.Errorf("Unable to increase serial: %v", err)
+		}
+	}
+
+	if p.rectify {
+		if err = p.request(ctx, http.MethodPut, "/rectify", nil, nil); err != nil {
+			return fmt.Errorf("Unable to rectify zone: %v", err)
+		}
+	}
+
+	if p.notify {
+		_, err = p.client.Zones.Notify(ctx, p.zone)
+	}
+
+	return
+}
+
+// Check reads the kind and the soa_edit_api setting of the zone
+func (p *PowerDNS) Check(ctx context.Context) ([]string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.check(ctx)
+}
+
+func (p *PowerDNS) check(ctx context.Context) (warnings []string, err error) {
+	z, err := p.client.Zones.Get(ctx, p.zone)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get zone %v: %v", p.zone, err)
+	}
+
+	kind := powerdns.ZoneKind("")
+	if z.Kind != nil {
+		kind = *z.Kind
+	}
+
+	switch kind {
+	case powerdns.MasterZoneKind, powerdns.ProducerZoneKind:
+		p.notify = true
+	case powerdns.NativeZoneKind:
+		p.notify = false
+		warnings = append(warnings, "Zone is Native, secondaries are only updated by their refresh timer. Use the Master kind to send NOTIFY after changes")
+	default:
+		return nil, fmt.Errorf("Zone %v is of kind %v and can not be updated", p.zone, kind)
+	}
+
+	soaEditAPI := strings.ToUpper(powerdns.StringValue(z.SOAEditAPI))
+	p.bumpSerial = soaEditAPI == "" || soaEditAPI == "OFF"
+	if p.bumpSerial {
+		warnings = append(warnings, "soa_edit_api is disabled on the zone, the serial is increased by calaos_dns after each change. Set it to DEFAULT or INCREASE")
+	}
+
+	//Signatures of a DNSSEC zone are only valid after a rectify. It is done
+	//by PowerDNS itself with api_rectify, by Notify otherwise.
+	p.rectify = powerdns.BoolValue(z.DNSsec) && !powerdns.BoolValue(z.APIRectify)
+	if p.rectify {
+		warnings = append(warnings, "api_rectify is disabled on the DNSSEC zone, the zone is rectified by calaos_dns after each change")
+	}
+
+	p.checked = true
+
+	return
+}
+
+func (p *PowerDNS) increaseSerial(ctx context.Context) error {
+	soaType := powerdns.RRTypeSOA
+	rrsets, err := p.client.Records.Get(ctx, p.zone, p.zone+".", &soaType)
+	if err != nil {
+		return err
+	}
+
+	for _, rr := range rrsets {
+		r := fromRRset(&rr)
+		if r.Type != TypeSOA || r.Name != CanonicalName(p.zone) || len(r.Content) != 1 {
+			continue
+		}
+
+		fields := strings.Fields(r.Content[0])
+		if len(fields) != 7 {
+			return fmt.Errorf("Invalid SOA: %v", r.Content[0])
+		}
+
+		serial, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return fmt.Errorf("Invalid SOA serial: %v", fields[2])
+		}
+		fields[2] = strconv.FormatUint(uint64(uint32(serial+1)), 10)
+
+		return p.client.Records.Change(ctx, p.zone, p.zone+".", powerdns.RRTypeSOA, r.TTL, []string{strings.Join(fields, " ")})
+	}
+
+	return fmt.Errorf("No SOA found for zone %v", p.zone)
+}
+
+// pdnsKey is a cryptokey of the PowerDNS API. The published flag is
+// missing from the client library.
+type pdnsKey struct {
+	ID        uint64   `json:"id,omitempty"`
+	KeyType   string   `json:"keytype,omitempty"`
+	Active    *bool    `json:"active,omitempty"`
+	Published *bool    `json:"published,omitempty"`
+	Algorithm string   `json:"algorithm,omitempty"`
+	Bits      int      `json:"bits,omitempty"`
+	DNSkey    string   `json:"dnskey,omitempty"`
+	DS        []string `json:"ds,omitempty"`
+}
+
+func (k *pdnsKey) key() *Key {
+	return &Key{
+		ID:        k.ID,
+		Type:      k.KeyType,
+		Active:    powerdns.BoolValue(k.Active),
+		Published: k.Published == nil || *k.Published,
+		Algorithm: k.Algorithm,
+		Bits:      k.Bits,
+		DNSKEY:    k.DNSkey,
+		DS:        k.DS,
+	}
+}
+
+// EnableDNSSEC creates an active KSK and ZSK if the zone has no active key
+// yet, and enables api_rectify on the zone
+func (p *PowerDNS) EnableDNSSEC(ctx context.Context) (err error) {
+	keys, err := p.ListKeys(ctx)
+	if err != nil {
+		return
+	}
+
+	hasKey := make(map[string]bool)
+	for _, k := range keys {
+		if k.Active {
+			hasKey[k.Type] = true
+		}
+	}
+
+	if !hasKey[KeyKSK] && !hasKey[KeyCSK] {
+		if _, err = p.AddKey(ctx, KeyKSK, true); err != nil {
+			return
+		}
+	}
+	if !hasKey[KeyZSK] && !hasKey[KeyCSK] {
+		if _, err = p.AddKey(ctx, KeyZSK, true); err != nil {
+			return
+		}
+	}
+
+	err = p.client.Zones.Change(ctx, p.zone, &powerdns.Zone{APIRectify: powerdns.Bool(true)})
+	if err != nil {
+		return fmt.Errorf("Unable to enable api_rectify: %v", err)
+	}
+
+	err = p.request(ctx, http.MethodPut, "/rectify", nil, nil)
+	if err != nil {
+		return fmt.Errorf("Unable to rectify zone: %v", err)
+	}
+
+	//zone settings changed
+	p.lock.Lock()
+	p.checked = false
+	p.lock.Unlock()
+
+	return
+}
+
+func (p *PowerDNS) ListKeys(ctx context.Context) (keys []Key, err error) {
+	var pkeys []pdnsKey
+	err = p.request(ctx, http.MethodGet, "/cryptokeys", nil, &pkeys)
+	for i := range pkeys {
+		keys = append(keys, *pkeys[i].key())
+	}
+
+	return
+}
+
+func (p *PowerDNS) AddKey(ctx context.Context, keyType string, active bool) (*Key, error) {
+	k := &pdnsKey{
+		KeyType:   keyType,
+		Active:    powerdns.Bool(active),
+		Published: powerdns.Bool(true),
+		Algorithm: "ECDSAP256SHA256",
+	}
+
+	err := p.request(ctx, http.MethodPost, "/cryptokeys", k, k)
+	if err != nil {
+		return nil, err
+	}
+
+	return k.key(), nil
+}
+
+func (p *PowerDNS) SetKeyActive(ctx context.Context, id uint64, active bool) error {
+	k := &pdnsKey{
+		Active: powerdns.Bool(active),
+	}
+	return p.request(ctx, http.MethodPut, fmt.Sprintf("/cryptokeys/%d", id), k, nil)
+}
+
+func (p *PowerDNS) DeleteKey(ctx context.Context, id uint64) error {
+	return p.client.Cryptokeys.Delete(ctx, p.zone, id)
+}
+
+// request calls an endpoint of the zone not covered by the client library
+func (p *PowerDNS) request(ctx context.Context, method, path string, body, out interface{}) error {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	url := fmt.Sprintf("%v/api/v1/servers/localhost/zones/%v.%v", p.api, p.zone, path)
+	req, err := http.NewRequestWithContext(ctx, method, url, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-Key", p.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &powerdns.Error{Status: resp.Status, StatusCode: resp.StatusCode}
+		json.NewDecoder(resp.Body).Decode(apiErr)
+		if apiErr.Message == "" {
+			apiErr.Message = resp.Status
+		}
+		return apiErr
+	}
+
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+
+	return nil
+}
@@ -0,0 +1,222 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RFC2136 publishes records with DNS UPDATE messages signed with TSIG. It
+// works with any server supporting dynamic updates like BIND or Knot. The
+// zone is read back with a zone transfer signed with the same key.
+type RFC2136 struct {
+	server    string
+	zone      string
+	keyName   string
+	algorithm string
+	secret    string
+	timeout   time.Duration
+}
+
+// NewRFC2136 creates a backend sending its updates to server (host:port, the
+// port is 53 by default). secret is the base64 TSIG key and algorithm its
+// name (hmac-sha256...).
+func NewRFC2136(server, zone, keyName, algorithm, secret string) *RFC2136 {
+	if algorithm == "" {
+		algorithm = dns.HmacSHA256
+	}
+
+	//The port is optional, server may also be a bare IPv6 address
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+	}
+
+	return &RFC2136{
+		server:    server,
+		zone:      dns.Fqdn(zone),
+		keyName:   dns.Fqdn(keyName),
+		algorithm: dns.Fqdn(strings.ToLower(algorithm)),
+		secret:    secret,
+		timeout:   10 * time.Second,
+	}
+}
+
+// Apply sends all changes in a single UPDATE message, which the server
+// applies atomically (RFC 2136 section 3.4)
+func (r *RFC2136) Apply(ctx context.Context, changes []Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate(r.zone)
+
+	for _, c := range changes {
+		m.RemoveRRset([]dns.RR{anyRR(c.Name, c.Type)})
+		if c.Delete {
+			continue
+		}
+
+		var rrs []dns.RR
+		for _, content := range c.Content {
+			rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(c.Name), c.TTL, c.Type, content))
+			if err != nil {
+				return err
+			}
+			rrs = append(rrs, rr)
+		}
+		m.Insert(rrs)
+	}
+
+	return r.update(ctx, m)
+}
+
+func (r *RFC2136) UpsertRRset(ctx context.Context, name string, rrtype RRType, ttl uint32, content []string) error {
+	return r.Apply(ctx, []Change{Upsert(name, rrtype, ttl, content)})
+}
+
+func (r *RFC2136) DeleteRRset(ctx context.Context, name string, rrtype RRType) error {
+	return r.Apply(ctx, []Change{Delete(name, rrtype)})
+}
+
+func (r *RFC2136) ListRecords(ctx context.Context, name string) (records []Record, err error) {
+	zone, err := r.GetZone(ctx)
+	if err != nil {
+		return
+	}
+
+	name = CanonicalName(name)
+	for _, rec := range zone.Records {
+		if rec.Name == name {
+			records = append(records, rec)
+		}
+	}
+
+	return
+}
+
+func (r *RFC2136) GetZone(ctx context.Context) (*Zone, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(r.zone)
+	r.sign(m)
+
+	t := &dns.Transfer{
+		DialTimeout:  r.timeout,
+		ReadTimeout:  r.timeout,
+		WriteTimeout: r.timeout,
+		TsigSecret:   r.tsigSecret(),
+	}
+	env, err := t.In(m, r.server)
+	if err != nil {
+		return nil, err
+	}
+
+	zone := &Zone{
+		Name: CanonicalName(r.zone),
+	}
+
+	//Group the records by RRset, the SOA is sent twice
+	index := make(map[memoryKey]int)
+	for e := range env {
+		if e.Error != nil {
+			return nil, e.Error
+		}
+
+		for _, rr := range e.RR {
+			h := rr.Header()
+			if soa, ok := rr.(*dns.SOA); ok {
+				if zone.Serial != 0 {
+					continue
+				}
+				zone.Serial = soa.Serial
+			}
+
+			key := memoryKey{CanonicalName(h.Name), RRType(dns.TypeToString[h.Rrtype])}
+			i, ok := index[key]
+			if !ok {
+				zone.Records = append(zone.Records, Record{
+					Name: key.name,
+					Type: key.rrtype,
+					TTL:  h.Ttl,
+				})
+				i = len(zone.Records) - 1
+				index[key] = i
+			}
+			zone.Records[i].Content = append(zone.Records[i].Content, RRContent(rr))
+		}
+	}
+
+	return zone, nil
+}
+
+// Notify does nothing, the server increases the serial after each dynamic
+// update and notifies its secondaries itself
+func (r *RFC2136) Notify(ctx context.Context) error {
+	return nil
+}
+
+// Check makes sure the zone can be transferred with the TSIG key
+func (r *RFC2136) Check(ctx context.Context) (warnings []string, err error) {
+	zone, err := r.GetZone(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to transfer zone %v from %v: %v", r.zone, r.server, err)
+	}
+
+	if zone.Serial == 0 {
+		warnings = append(warnings, "No SOA found in zone transfer")
+	}
+
+	return
+}
+
+func (r *RFC2136) update(ctx context.Context, m *dns.Msg) error {
+	r.sign(m)
+
+	c := &dns.Client{
+		Net:        "tcp",
+		Timeout:    r.timeout,
+		TsigSecret: r.tsigSecret(),
+	}
+	reply, _, err := c.ExchangeContext(ctx, m, r.server)
+	if err != nil {
+		return err
+	}
+
+	if reply.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("DNS update failed: %v", dns.RcodeToString[reply.Rcode])
+	}
+
+	return nil
+}
+
+func (r *RFC2136) sign(m *dns.Msg) {
+	if r.keyName != "." && r.secret != "" {
+		m.SetTsig(r.keyName, r.algorithm, 300, time.Now().Unix())
+	}
+}
+
+func (r *RFC2136) tsigSecret() map[string]string {
+	if r.keyName == "." || r.secret == "" {
+		return nil
+	}
+	return map[string]string{r.keyName: r.secret}
+}
+
+// anyRR returns the RR used to match a whole RRset in an update
+func anyRR(name string, rrtype RRType) dns.RR {
+	return &dns.ANY{Hdr: dns.RR_Header{
+		Name:   dns.Fqdn(name),
+		Rrtype: dns.StringToType[string(rrtype)],
+		Class:  dns.ClassANY,
+	}}
+}
+
+// RRContent returns the data of rr in presentation format, as used in
+// Record.Content
+func RRContent(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
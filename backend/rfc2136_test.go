@@ -0,0 +1,303 @@
+package backend
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	testZone   = "calaos.fr"
+	testKey    = "calaos-dns."
+	testSecret = "c2VjcmV0LWtleS1vZi10aGUtdGVzdHM="
+)
+
+// testServer is a DNS server accepting the TSIG signed updates and zone
+// transfers of testZone
+type testServer struct {
+	lock    sync.Mutex
+	serial  uint32
+	rrs     []dns.RR
+	updates []*dns.Msg
+	addr    string
+}
+
+func startTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{
+		serial: 1,
+		addr:   l.Addr().String(),
+	}
+
+	started := make(chan struct{})
+	srv := &dns.Server{
+		Listener:          l,
+		Net:               "tcp",
+		TsigSecret:        map[string]string{testKey: testSecret},
+		Handler:           s,
+		MsgAcceptFunc:     acceptUpdates,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+
+	return s
+}
+
+// acceptUpdates also accepts the UPDATE messages that the default
+// MsgAcceptFunc rejects as not implemented
+func acceptUpdates(dh dns.Header) dns.MsgAcceptAction {
+	if int(dh.Bits>>11)&0xF == dns.OpcodeUpdate {
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+func (s *testServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	tsig := r.IsTsig()
+	if tsig == nil || w.TsigStatus() != nil {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNotAuth)
+		w.WriteMsg(m)
+		return
+	}
+
+	if r.Opcode == dns.OpcodeUpdate {
+		s.update(r)
+
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+		w.WriteMsg(m)
+		return
+	}
+
+	if len(r.Question) == 1 && r.Question[0].Qtype == dns.TypeAXFR {
+		ch := make(chan *dns.Envelope)
+		tr := new(dns.Transfer)
+		go func() {
+			ch <- &dns.Envelope{RR: s.axfr()}
+			close(ch)
+		}()
+		tr.Out(w, r, ch)
+		w.Close()
+		return
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeRefused)
+	w.WriteMsg(m)
+}
+
+// update applies the RemoveRRset and Insert sections of r to the zone
+func (s *testServer) update(r *dns.Msg) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.updates = append(s.updates, r)
+	for _, rr := range r.Ns {
+		h := rr.Header()
+		if h.Class == dns.ClassANY {
+			var kept []dns.RR
+			for _, old := range s.rrs {
+				if !strings.EqualFold(old.Header().Name, h.Name) || old.Header().Rrtype != h.Rrtype {
+					kept = append(kept, old)
+				}
+			}
+			s.rrs = kept
+			continue
+		}
+		s.rrs = append(s.rrs, rr)
+	}
+	s.serial++
+}
+
+func (s *testServer) axfr() []dns.RR {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	soa := &dns.SOA{
+		Hdr:     dns.RR_Header{Name: dns.Fqdn(testZone), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:      "ns1." + dns.Fqdn(testZone),
+		Mbox:    "hostmaster." + dns.Fqdn(testZone),
+		Serial:  s.serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  604800,
+		Minttl:  60,
+	}
+
+	rrs := []dns.RR{soa}
+	rrs = append(rrs, s.rrs...)
+	return append(rrs, soa)
+}
+
+func (s *testServer) lastUpdate() *dns.Msg {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.updates) == 0 {
+		return nil
+	}
+	return s.updates[len(s.updates)-1]
+}
+
+func TestRFC2136Apply(t *testing.T) {
+	s := startTestServer(t)
+	b := NewRFC2136(s.addr, testZone, "calaos-dns", "hmac-sha256", testSecret)
+	ctx := context.Background()
+
+	err := b.Apply(ctx, []Change{
+		Upsert("myhome.calaos.fr", TypeA, 60, []string{"1.2.3.4"}),
+		Upsert("_acme-challenge.myhome.calaos.fr", TypeTXT, 60, []string{`"value1"`, `"value2"`}),
+		Delete("old.calaos.fr", TypeAAAA),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Each RRset is removed and then inserted again in a single update
+	m := s.lastUpdate()
+	if m == nil {
+		t.Fatal("no update received")
+	}
+	if m.Question[0].Name != "calaos.fr." {
+		t.Errorf("update of zone %v", m.Question[0].Name)
+	}
+
+	var got []string
+	for _, rr := range m.Ns {
+		h := rr.Header()
+		op := "insert"
+		if h.Class == dns.ClassANY {
+			op = "remove"
+		}
+		got = append(got, op+" "+h.Name+" "+dns.TypeToString[h.Rrtype])
+	}
+	want := []string{
+		"remove myhome.calaos.fr. A",
+		"insert myhome.calaos.fr. A",
+		"remove _acme-challenge.myhome.calaos.fr. TXT",
+		"insert _acme-challenge.myhome.calaos.fr. TXT",
+		"insert _acme-challenge.myhome.calaos.fr. TXT",
+		"remove old.calaos.fr. AAAA",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("update sections:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	//Upsert replaces the RRset
+	if err = b.UpsertRRset(ctx, "myhome.calaos.fr", TypeA, 60, []string{"5.6.7.8"}); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := b.ListRecords(ctx, "myhome.calaos.fr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || !reflect.DeepEqual(records[0].Content, []string{"5.6.7.8"}) {
+		t.Errorf("records of myhome.calaos.fr: %v", records)
+	}
+}
+
+func TestRFC2136GetZone(t *testing.T) {
+	s := startTestServer(t)
+	b := NewRFC2136(s.addr, testZone, "calaos-dns", "hmac-sha256", testSecret)
+	ctx := context.Background()
+
+	err := b.Apply(ctx, []Change{
+		Upsert("myhome.calaos.fr", TypeA, 60, []string{"1.2.3.4"}),
+		Upsert("myhome.calaos.fr", TypeAAAA, 60, []string{"2001:db8::1"}),
+		Upsert("_acme-challenge.myhome.calaos.fr", TypeTXT, 60, []string{`"value1"`, `"value2"`}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zone, err := b.GetZone(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if zone.Name != testZone || zone.Serial != 2 {
+		t.Errorf("zone %v serial %v", zone.Name, zone.Serial)
+	}
+
+	got := make(map[string][]string)
+	for _, r := range zone.Records {
+		got[r.Name+" "+string(r.Type)] = r.Content
+	}
+	want := map[string][]string{
+		"myhome.calaos.fr A":                   {"1.2.3.4"},
+		"myhome.calaos.fr AAAA":                {"2001:db8::1"},
+		"_acme-challenge.myhome.calaos.fr TXT": {`"value1"`, `"value2"`},
+		"calaos.fr SOA":                        nil,
+	}
+	for k, v := range want {
+		c, ok := got[k]
+		if !ok {
+			t.Errorf("%v missing from zone", k)
+		} else if v != nil && !reflect.DeepEqual(c, v) {
+			t.Errorf("%v = %v, want %v", k, c, v)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("zone has %v RRsets, want %v: %v", len(got), len(want), got)
+	}
+
+	if _, err = b.Check(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRFC2136BadKey(t *testing.T) {
+	s := startTestServer(t)
+	ctx := context.Background()
+
+	for _, b := range []*RFC2136{
+		NewRFC2136(s.addr, testZone, "calaos-dns", "hmac-sha256", "d3Jvbmcta2V5"),
+		NewRFC2136(s.addr, testZone, "other-key", "hmac-sha256", testSecret),
+		NewRFC2136(s.addr, testZone, "", "", ""),
+	} {
+		err := b.Apply(ctx, []Change{Upsert("myhome.calaos.fr", TypeA, 60, []string{"1.2.3.4"})})
+		if err == nil {
+			t.Errorf("update with key %v accepted", b.keyName)
+		}
+
+		if _, err = b.GetZone(ctx); err == nil {
+			t.Errorf("zone transfer with key %v accepted", b.keyName)
+		}
+	}
+
+	if m := s.lastUpdate(); m != nil {
+		t.Errorf("update applied with a bad key: %v", m)
+	}
+}
+
+func TestRFC2136Server(t *testing.T) {
+	for server, want := range map[string]string{
+		"ns1.calaos.fr":      "ns1.calaos.fr:53",
+		"ns1.calaos.fr:5353": "ns1.calaos.fr:5353",
+		"192.0.2.1":          "192.0.2.1:53",
+		"2001:db8::1":        "[2001:db8::1]:53",
+		"[2001:db8::1]":      "[2001:db8::1]:53",
+		"[2001:db8::1]:5353": "[2001:db8::1]:5353",
+	} {
+		if got := NewRFC2136(server, testZone, "", "", "").server; got != want {
+			t.Errorf("server %v = %v, want %v", server, got, want)
+		}
+	}
+}
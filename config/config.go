@@ -10,14 +10,72 @@ var (
 
 type Config struct {
 	General struct {
-		Port           int
-		ExpirationDays int `toml:"expiration_days"`
+		Port                   int
+		ExpirationDays         int      `toml:"expiration_days"`
+		ReconcileRepair        bool     `toml:"reconcile_repair"`
+		ReconcileDeleteOrphans bool     `toml:"reconcile_delete_orphans"`
+		ChallengeLifetimeHours int      `toml:"challenge_lifetime_hours"`
+		ParkingIP              string   `toml:"parking_ip"`
+		ParkingIPv6            string   `toml:"parking_ipv6"`
+		TrustedProxies         []string `toml:"trusted_proxies"`
+	}
+	Backend struct {
+		Type string
 	}
 	Powerdns struct {
 		Api       string
 		ApiKey    string `toml:"api_key"`
 		Zone      string
-		Blacklist []string
+		Blacklist []string //only seeds the reserved names table
+	}
+	Rfc2136 struct {
+		Server    string
+		KeyName   string `toml:"key_name"`
+		Algorithm string
+		Secret    string
+	}
+	Dnsserver struct {
+		Enabled     bool
+		Listen      string
+		Nameservers []string
+		Hostmaster  string
+		Secondaries []string
+	}
+	Dnssec struct {
+		ZskRolloverDays    int `toml:"zsk_rollover_days"`
+		RolloverDelayHours int `toml:"rollover_delay_hours"`
+	}
+	Certificates struct {
+		Directory            string
+		Email                string
+		EncryptionKey        string `toml:"encryption_key"`
+		RenewDays            int    `toml:"renew_days"`
+		Resolvers            []string
+		SkipPropagationCheck bool `toml:"skip_propagation_check"`
+	}
+	Propagation struct {
+		Nameservers []string
+		Timeout     int
+	}
+	Signing struct {
+		MaxAge        int    `toml:"max_age"`        //seconds a signed request is valid
+		EncryptionKey string `toml:"encryption_key"` //encrypts the signing secrets in DB
+	}
+	Ratelimit struct {
+		Rate             float64 //requests per minute of a source IP, 0 disables the limit
+		Burst            int
+		TokenRate        float64 `toml:"token_rate"` //requests per minute of a token
+		TokenBurst       int     `toml:"token_burst"`
+		HostsPerIP       int     `toml:"hosts_per_ip"` //hosts registered by a source IP in the window
+		HostsWindowHours int     `toml:"hosts_window_hours"`
+		Persist          bool
+	}
+	Accounts struct {
+		JwtSecret  string `toml:"jwt_secret"`
+		TokenHours int    `toml:"token_hours"`
+	}
+	Admin struct {
+		ApiKeys []string `toml:"api_keys"`
 	}
 	Database struct {
 		Dsn  string
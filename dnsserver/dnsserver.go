@@ -0,0 +1,339 @@
+package dnsserver
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/calaos/calaos_dns/backend"
+	"github.com/calaos/calaos_dns/config"
+	"github.com/calaos/calaos_dns/models"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	zone    string
+	servers []*dns.Server
+	stop    chan struct{}
+
+	serialLock sync.Mutex
+	serial     uint32 //last serial read from DB
+	notified   uint32 //last serial sent to the secondaries
+)
+
+// Interval between two checks of the serial in DB, to notify the
+// secondaries of the changes made by other processes
+const serialCheckInterval = 30 * time.Second
+
+// Start serves the zone on UDP and TCP. Records are built from the Host
+// table, and the secondaries are notified after every change.
+func Start() (err error) {
+	zone = dns.Fqdn(config.Conf.Powerdns.Zone)
+	notified = currentSerial()
+
+	listen := config.Conf.Dnsserver.Listen
+	if listen == "" {
+		listen = ":53"
+	}
+
+	pc, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		return fmt.Errorf("Failed to listen on udp %v: %v", listen, err)
+	}
+
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		pc.Close()
+		return fmt.Errorf("Failed to listen on tcp %v: %v", listen, err)
+	}
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(zone, handleQuery)
+	mux.HandleFunc(".", handleRefused)
+
+	servers = []*dns.Server{
+		{PacketConn: pc, Handler: mux},
+		{Listener: l, Handler: mux},
+	}
+	for _, s := range servers {
+		go func(s *dns.Server) {
+			if err := s.ActivateAndServe(); err != nil {
+				log.Println("DNS server stopped:", err)
+			}
+		}(s)
+	}
+
+	models.OnZoneChange(zoneChanged)
+
+	stop = make(chan struct{})
+	go checkSerial(stop)
+
+	log.Println("DNS server listening on", listen, "for zone", zone)
+
+	return
+}
+
+// Stop shuts the DNS server down
+func Stop() {
+	for _, s := range servers {
+		s.Shutdown()
+	}
+	servers = nil
+
+	if stop != nil {
+		close(stop)
+		stop = nil
+	}
+}
+
+// currentSerial returns the serial of the zone kept in DB, the last serial
+// read if the DB can't be reached
+func currentSerial() uint32 {
+	s, err := models.GetZoneSerial()
+
+	serialLock.Lock()
+	defer serialLock.Unlock()
+
+	if err != nil {
+		log.Println("Unable to read zone serial:", err)
+		return serial
+	}
+	serial = s
+	return serial
+}
+
+func zoneChanged() {
+	go notifyChanges()
+}
+
+// checkSerial notifies the secondaries when the zone has been changed by
+// another process
+func checkSerial(stop chan struct{}) {
+	t := time.NewTicker(serialCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			notifyChanges()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// notifyChanges notifies the secondaries if the serial has changed since
+// the last notification
+func notifyChanges() {
+	s := currentSerial()
+
+	serialLock.Lock()
+	changed := s != notified
+	notified = s
+	serialLock.Unlock()
+
+	if changed {
+		notifySecondaries()
+	}
+}
+
+func handleRefused(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeRefused)
+	w.WriteMsg(m)
+}
+
+func handleQuery(w dns.ResponseWriter, r *dns.Msg) {
+	if r.Opcode != dns.OpcodeQuery || len(r.Question) != 1 {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNotImplemented)
+		w.WriteMsg(m)
+		return
+	}
+
+	q := r.Question[0]
+	if q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+		transferZone(w, r)
+		return
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	records, exists := lookup(q.Name)
+	for _, rr := range records {
+		if q.Qtype == dns.TypeANY || rr.Header().Rrtype == q.Qtype {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+
+	if !exists {
+		m.Rcode = dns.RcodeNameError
+	}
+	if len(m.Answer) == 0 {
+		m.Ns = []dns.RR{soaRecord()}
+	}
+
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+			m.SetEdns0(opt.UDPSize(), false)
+		}
+		m.Truncate(size)
+	}
+
+	w.WriteMsg(m)
+}
+
+// lookup returns the records of name and whether name exists in the zone
+func lookup(name string) (rrs []dns.RR, exists bool) {
+	if dns.Fqdn(strings.ToLower(name)) == zone {
+		return apexRecords(), true
+	}
+
+	records, exists := models.LookupRecords(name)
+	return toRRs(records), exists
+}
+
+func transferZone(w dns.ResponseWriter, r *dns.Msg) {
+	_, isTCP := w.RemoteAddr().(*net.TCPAddr)
+	if !isTCP || !isSecondary(w.RemoteAddr()) {
+		log.Println("Zone transfer refused for", w.RemoteAddr())
+		handleRefused(w, r)
+		return
+	}
+
+	records, err := models.ZoneRecords()
+	if err != nil {
+		log.Println("Unable to build zone for transfer:", err)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return
+	}
+
+	soa := soaRecord()
+	rrs := append([]dns.RR{soa}, apexRecords()[1:]...)
+	rrs = append(rrs, toRRs(records)...)
+	rrs = append(rrs, soa)
+
+	log.Println("Zone transfer of", zone, "to", w.RemoteAddr())
+
+	ch := make(chan *dns.Envelope)
+	tr := new(dns.Transfer)
+	go func() {
+		for len(rrs) > 0 {
+			n := 100
+			if n > len(rrs) {
+				n = len(rrs)
+			}
+			ch <- &dns.Envelope{RR: rrs[:n]}
+			rrs = rrs[n:]
+		}
+		close(ch)
+	}()
+
+	if err = tr.Out(w, r, ch); err != nil {
+		log.Println("Zone transfer failed:", err)
+	}
+	for range ch {
+		//drain what was not sent
+	}
+	w.Close()
+}
+
+func notifySecondaries() {
+	for _, s := range config.Conf.Dnsserver.Secondaries {
+		addr := secondaryAddr(s)
+
+		m := new(dns.Msg)
+		m.SetNotify(zone)
+
+		c := &dns.Client{Timeout: 5 * time.Second}
+		_, _, err := c.Exchange(m, addr)
+		if err != nil {
+			log.Println("Failed to notify secondary", addr, ":", err)
+		}
+	}
+}
+
+func isSecondary(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+
+	for _, s := range config.Conf.Dnsserver.Secondaries {
+		h, _, err := net.SplitHostPort(secondaryAddr(s))
+		if err == nil && net.ParseIP(h).Equal(net.ParseIP(host)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// secondaryAddr returns the host:port of a secondary from the config
+func secondaryAddr(s string) string {
+	if _, _, err := net.SplitHostPort(s); err == nil {
+		return s
+	}
+	return net.JoinHostPort(s, "53")
+}
+
+func soaRecord() dns.RR {
+	ns := "ns1." + zone
+	if len(config.Conf.Dnsserver.Nameservers) > 0 {
+		ns = dns.Fqdn(config.Conf.Dnsserver.Nameservers[0])
+	}
+
+	mbox := "hostmaster." + zone
+	if config.Conf.Dnsserver.Hostmaster != "" {
+		mbox = dns.Fqdn(strings.Replace(config.Conf.Dnsserver.Hostmaster, "@", ".", 1))
+	}
+
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:      ns,
+		Mbox:    mbox,
+		Serial:  currentSerial(),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  604800,
+		Minttl:  60,
+	}
+}
+
+// apexRecords returns the SOA followed by the NS records of the zone
+func apexRecords() (rrs []dns.RR) {
+	rrs = append(rrs, soaRecord())
+	for _, ns := range config.Conf.Dnsserver.Nameservers {
+		rrs = append(rrs, &dns.NS{
+			Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600},
+			Ns:  dns.Fqdn(ns),
+		})
+	}
+
+	return
+}
+
+func toRRs(records []backend.Record) (rrs []dns.RR) {
+	for _, r := range records {
+		for _, c := range r.Content {
+			rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(r.Name), r.TTL, r.Type, c))
+			if err != nil {
+				log.Println("Invalid record", r.Name, r.Type, c, ":", err)
+				continue
+			}
+			rrs = append(rrs, rr)
+		}
+	}
+
+	return
+}
@@ -4,17 +4,22 @@ go 1.13
 
 require (
 	github.com/BurntSushi/toml v1.3.2
-	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
+	github.com/cenkalti/backoff v2.1.1+incompatible // indirect
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/fatih/color v1.16.0
-	github.com/go-acme/lego v2.7.2+incompatible // indirect
+	github.com/go-acme/lego v2.7.2+incompatible
 	github.com/go-sql-driver/mysql v1.7.1 // indirect
 	github.com/jawher/mow.cli v1.2.0
 	github.com/jinzhu/gorm v1.9.16
 	github.com/joeig/go-powerdns/v3 v3.10.0
 	github.com/labstack/echo v3.3.10+incompatible
 	github.com/labstack/gommon v0.4.2 // indirect
+	github.com/mattn/go-sqlite3 v1.14.16 // indirect
+	github.com/miekg/dns v1.1.50
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/robfig/cron v1.2.0
 	github.com/xenolf/lego v2.7.2+incompatible
+	golang.org/x/crypto v0.19.0
 	golang.org/x/net v0.21.0 // indirect
+	gopkg.in/square/go-jose.v2 v2.3.1 // indirect
 )
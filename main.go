@@ -8,6 +8,7 @@ import (
 
 	"github.com/calaos/calaos_dns/app"
 	"github.com/calaos/calaos_dns/config"
+	"github.com/calaos/calaos_dns/dnsserver"
 	"github.com/calaos/calaos_dns/models"
 
 	"github.com/fatih/color"
@@ -40,6 +41,7 @@ var (
 
 func exit(err error, exit int) {
 	fmt.Fprintln(os.Stderr, errorRed(CharAbort), err)
+	models.WaitNotify()
 	cli.Exit(exit)
 }
 
@@ -55,6 +57,37 @@ func main() {
 	mnApp.Command("zone", "DNS zones management", func(cmd *cli.Cmd) {
 		cmd.Command("list", "list all registered subdomains", cmdDnsList)
 		cmd.Command("delete", "delete a registered subdomains", cmdDnsDelete)
+		cmd.Command("check", "compare the zone with the registered hosts", cmdZoneCheck)
+		cmd.Command("repair", "fix the zone to match the registered hosts", cmdZoneRepair)
+		cmd.Command("propagation", "check that all nameservers serve the challenge of a host", cmdZonePropagation)
+		cmd.Command("suspend", "replace the records of a host by the parking addresses", cmdZoneSuspend)
+		cmd.Command("unsuspend", "publish again the records of a suspended host", cmdZoneUnsuspend)
+	})
+
+	mnApp.Command("dnssec", "DNSSEC management of the zone", func(cmd *cli.Cmd) {
+		cmd.Command("enable", "sign the zone", cmdDnssecEnable)
+		cmd.Command("keys", "list the signing keys and the ZSK rollover state", cmdDnssecKeys)
+		cmd.Command("ds", "show the DS records to give to the registrar", cmdDnssecDS)
+		cmd.Command("rollover", "start a ZSK rollover, completed later by the server", cmdDnssecRollover)
+	})
+
+	mnApp.Command("cert", "Certificates issued for the hosts", func(cmd *cli.Cmd) {
+		cmd.Command("list", "list the certificates of all hosts", cmdCertList)
+		cmd.Command("issue", "issue or renew the certificate of a host", cmdCertIssue)
+	})
+
+	mnApp.Command("token", "Tokens of the hosts", func(cmd *cli.Cmd) {
+		cmd.Command("list", "list the tokens of a host", cmdTokenList)
+		cmd.Command("create", "create a new token for a host", cmdTokenCreate)
+		cmd.Command("rotate", "replace a token of a host by a new one", cmdTokenRotate)
+		cmd.Command("revoke", "revoke a token of a host", cmdTokenRevoke)
+	})
+
+	mnApp.Command("reserved", "Names that can't be registered", func(cmd *cli.Cmd) {
+		cmd.Command("list", "list the reserved name rules", cmdReservedList)
+		cmd.Command("add", "reserve the names matching a pattern", cmdReservedAdd)
+		cmd.Command("delete", "delete a reserved name rule", cmdReservedDelete)
+		cmd.Command("check", "show the rule reserving a name", cmdReservedCheck)
 	})
 
 	//Main action of the tool is to start the webserver
@@ -67,6 +100,12 @@ func main() {
 			exit(err, 1)
 		}
 
+		if config.Conf.Dnsserver.Enabled {
+			if err := dnsserver.Start(); err != nil {
+				exit(err, 1)
+			}
+		}
+
 		if err := app.Run(); err != nil {
 			exit(err, 1)
 		}
@@ -75,23 +114,31 @@ func main() {
 	if err := mnApp.Run(os.Args); err != nil {
 		exit(err, 1)
 	}
+
+	//Changes made by a command must reach the secondaries before exiting
+	models.WaitNotify()
+}
+
+// initModels loads the config and opens the DB. The cleanup jobs of the
+// server are not run so that the commands only do what they are asked for,
+// and nothing at all for a dry run.
+func initModels() {
+	if err := config.ReadConfig(*conffile); err != nil {
+		exit(fmt.Errorf("failed to read config file: %v", err), 1)
+	}
+
+	if err := models.Open(false); err != nil {
+		exit(err, 1)
+	}
 }
 
 func cmdDnsList(cmd *cli.Cmd) {
 	cmd.Action = func() {
-		if err := config.ReadConfig(*conffile); err != nil {
-			fmt.Printf("Failed to read config file: %v", err)
-			return
-		}
-
-		if err := models.Init(false); err != nil {
-			exit(err, 1)
-		}
+		initModels()
 
 		hosts, err := models.GetAllHosts()
 		if err != nil {
-			fmt.Println("failed to get hosts", err)
-			return
+			exit(fmt.Errorf("failed to get hosts: %v", err), 1)
 		}
 
 		fmt.Printf("Hosts:\n")
@@ -99,15 +146,18 @@ func cmdDnsList(cmd *cli.Cmd) {
 		for _, h := range hosts {
 			fmt.Printf("[%v] - %v\n", h.ID, h.Hostname+"."+config.Conf.Powerdns.Zone)
 			fmt.Printf("\tIP:\t\t%v\n", h.IP)
-			fmt.Printf("\tToken:\t\t%v\n", h.Token)
+			fmt.Printf("\tIPv6:\t\t%v\n", h.IPv6)
 			fmt.Printf("\tSubdomains:\t%v\n", h.Subzones)
 			tCheck := time.Now()
 			tCheck = tCheck.AddDate(0, 0, 0-config.Conf.General.ExpirationDays)
 			d := h.UpdatedAt.Sub(tCheck)
 			fmt.Printf("\tExpires in:\t%v\n", d)
+			if h.Suspended() {
+				fmt.Printf("\tSuspended:\t%v\n", h.SuspendedAt)
+			}
 
 			pdns := models.GetPdnsRecords(&h)
-			fmt.Printf("\tPowerDNS Records:\n")
+			fmt.Printf("\tDNS Records:\n")
 			for _, s := range pdns {
 				fmt.Printf("\t\t\t%v\n", s)
 			}
@@ -117,27 +167,438 @@ func cmdDnsList(cmd *cli.Cmd) {
 }
 
 func cmdDnsDelete(cmd *cli.Cmd) {
-	cmd.Spec = "TOKEN"
+	cmd.Spec = "HOSTNAME"
 	var (
-		token = cmd.StringArg("TOKEN", "", "Token for the zone")
+		hostname = cmd.StringArg("HOSTNAME", "", "Mainzone of the host")
 	)
 
 	cmd.Action = func() {
-		if err := config.ReadConfig(*conffile); err != nil {
-			fmt.Printf("Failed to read config file: %v", err)
-			return
+		initModels()
+
+		if err := models.DeleteHost(*hostname); err != nil {
+			exit(fmt.Errorf("failed to delete host: %v", err), 1)
 		}
 
-		if err := models.Init(false); err != nil {
-			exit(err, 1)
+		fmt.Println(green(CharCheck), "Host", *hostname, "deleted")
+	}
+
+}
+
+func cmdZoneSuspend(cmd *cli.Cmd) {
+	cmd.Spec = "HOSTNAME"
+	var (
+		hostname = cmd.StringArg("HOSTNAME", "", "Mainzone of the host")
+	)
+
+	cmd.Action = func() {
+		initModels()
+
+		if _, err := models.SuspendHost(*hostname); err != nil {
+			exit(fmt.Errorf("failed to suspend host: %v", err), 1)
+		}
+
+		fmt.Println(green(CharCheck), "Host", *hostname, "suspended")
+	}
+}
+
+func cmdZoneUnsuspend(cmd *cli.Cmd) {
+	cmd.Spec = "HOSTNAME"
+	var (
+		hostname = cmd.StringArg("HOSTNAME", "", "Mainzone of the host")
+	)
+
+	cmd.Action = func() {
+		initModels()
+
+		if _, err := models.UnsuspendHost(*hostname); err != nil {
+			exit(fmt.Errorf("failed to unsuspend host: %v", err), 1)
 		}
 
-		err := models.DeleteDns(*token)
+		fmt.Println(green(CharCheck), "Host", *hostname, "unsuspended")
+	}
+}
+
+func cmdZoneCheck(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		initModels()
+
+		report, err := models.CheckZone()
+		if err != nil {
+			exit(fmt.Errorf("failed to check zone: %v", err), 1)
+		}
+
+		printZoneReport(report)
+
+		if len(report.Issues) > 0 {
+			cli.Exit(2)
+		}
+	}
+}
+
+func cmdZoneRepair(cmd *cli.Cmd) {
+	cmd.Spec = "[--dry-run] [--delete-orphans]"
+	var (
+		dryRun        = cmd.BoolOpt("dry-run", false, "Only show what would be repaired")
+		deleteOrphans = cmd.BoolOpt("delete-orphans", false, "Also delete the records of hosts that are not in DB")
+	)
+
+	cmd.Action = func() {
+		initModels()
+
+		report, err := models.RepairZone(*dryRun, *deleteOrphans)
 		if err != nil {
-			fmt.Println("failed to delete host:", err)
+			exit(fmt.Errorf("failed to repair zone: %v", err), 1)
+		}
+
+		printZoneReport(report)
+
+		if len(report.Issues) == 0 {
+			return
+		}
+		if *dryRun {
+			fmt.Println(cyan(CharArrow), "Dry run, nothing has been changed")
 		} else {
-			fmt.Println("Host deleted")
+			fmt.Println(green(CharCheck), "Zone repaired")
+		}
+	}
+}
+
+func cmdZonePropagation(cmd *cli.Cmd) {
+	cmd.Spec = "[--value] [--wait] HOSTNAME [DOMAIN]"
+	var (
+		hostname = cmd.StringArg("HOSTNAME", "", "Mainzone of the host")
+		domain   = cmd.StringArg("DOMAIN", "", "Mainzone or subzone of the challenge, the mainzone by default")
+		value    = cmd.StringOpt("value", "", "Expected value, all outstanding values of the challenge by default")
+		wait     = cmd.IntOpt("wait", 0, "Seconds to wait for the propagation")
+	)
+
+	cmd.Action = func() {
+		initModels()
+
+		status, err := models.CheckHostPropagation(*hostname, *domain, *value, time.Duration(*wait)*time.Second)
+		if err != nil {
+			exit(fmt.Errorf("failed to check propagation: %v", err), 1)
+		}
+
+		fmt.Printf("Challenge:\t%v\n", status.Name)
+		fmt.Printf("Expected:\t%v\n", status.Expected)
+		fmt.Printf("---------------------\n")
+		for _, ns := range status.Nameservers {
+			if ns.Error != "" {
+				fmt.Println(errorRed(CharAbort), ns.Nameserver, ns.Error)
+			} else if ns.Ok {
+				fmt.Println(green(CharCheck), ns.Nameserver, ns.Values)
+			} else {
+				fmt.Println(errorRed(CharWarning), ns.Nameserver, ns.Values)
+			}
+		}
+
+		if !status.Propagated {
+			cli.Exit(2)
+		}
+	}
+}
+
+func printZoneReport(report *models.ZoneReport) {
+	fmt.Printf("Hosts:\t\t%v\n", report.Hosts)
+	fmt.Printf("Records:\t%v\n", report.Records)
+	fmt.Printf("---------------------\n")
+
+	if len(report.Issues) == 0 {
+		fmt.Println(green(CharCheck), "Zone matches the registered hosts")
+		return
+	}
+
+	for _, i := range report.Issues {
+		fmt.Println(errorRed(CharWarning), i)
+	}
+	fmt.Printf("%v issues found\n", len(report.Issues))
+}
+
+func cmdDnssecEnable(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		initModels()
+
+		if err := models.EnableDnssec(); err != nil {
+			exit(fmt.Errorf("failed to enable DNSSEC: %v", err), 1)
 		}
+
+		fmt.Println(green(CharCheck), "DNSSEC enabled for", config.Conf.Powerdns.Zone)
+		fmt.Println(cyan(CharArrow), "Give the DS records to the registrar:")
+		printDS()
 	}
+}
+
+func cmdDnssecKeys(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		initModels()
+
+		status, err := models.GetDnssecStatus()
+		if err != nil {
+			exit(fmt.Errorf("failed to get DNSSEC keys: %v", err), 1)
+		}
 
+		fmt.Printf("DNSSEC:\t\t%v\n", status.Enabled)
+		fmt.Printf("---------------------\n")
+		for _, k := range status.Keys {
+			fmt.Printf("[%v] - %v %v\n", k.ID, k.Type, k.Algorithm)
+			fmt.Printf("\tActive:\t\t%v\n", k.Active)
+			fmt.Printf("\tPublished:\t%v\n", k.Published)
+			fmt.Printf("\tDNSKEY:\t\t%v\n", k.DNSKEY)
+		}
+
+		if r := status.Rollover; r != nil {
+			fmt.Printf("ZSK rollover:\t%v (%v -> %v) since %v\n", r.Stage, r.OldKey, r.NewKey, r.UpdatedAt)
+		}
+	}
+}
+
+func cmdDnssecDS(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		initModels()
+
+		printDS()
+	}
+}
+
+func cmdDnssecRollover(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		initModels()
+
+		r, err := models.StartZskRollover()
+		if err != nil {
+			exit(fmt.Errorf("failed to start ZSK rollover: %v", err), 1)
+		}
+
+		fmt.Println(green(CharCheck), "New ZSK", r.NewKey, "published, the server will complete the rollover")
+	}
+}
+
+func printDS() {
+	ds, err := models.GetDnssecDS()
+	if err != nil {
+		exit(fmt.Errorf("failed to get DS records: %v", err), 1)
+	}
+
+	for _, d := range ds {
+		fmt.Printf("%v. IN DS %v\n", config.Conf.Powerdns.Zone, d)
+	}
+}
+
+func cmdCertList(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		initModels()
+
+		certs, err := models.GetAllCertificates()
+		if err != nil {
+			exit(fmt.Errorf("failed to get certificates: %v", err), 1)
+		}
+
+		fmt.Printf("Certificates:\n")
+		fmt.Printf("---------------------\n")
+		for hostname, c := range certs {
+			fmt.Printf("%v\n", hostname+"."+config.Conf.Powerdns.Zone)
+			fmt.Printf("\tStatus:\t\t%v\n", c.Status)
+			fmt.Printf("\tDomains:\t%v\n", c.Domains)
+			if c.NotAfter != nil {
+				fmt.Printf("\tExpires:\t%v\n", c.NotAfter)
+			}
+			if c.Error != "" {
+				fmt.Printf("\tError:\t\t%v\n", c.Error)
+			}
+		}
+	}
+}
+
+func cmdCertIssue(cmd *cli.Cmd) {
+	cmd.Spec = "HOSTNAME"
+	var (
+		hostname = cmd.StringArg("HOSTNAME", "", "Mainzone of the host")
+	)
+
+	cmd.Action = func() {
+		initModels()
+
+		if err := models.IssueCertificate(*hostname); err != nil {
+			exit(fmt.Errorf("failed to issue certificate: %v", err), 1)
+		}
+
+		fmt.Println(green(CharCheck), "Certificate issued for", *hostname)
+	}
+}
+
+// tokenCmdHost loads the config and returns the host hostname
+func tokenCmdHost(hostname string) *models.Host {
+	initModels()
+
+	h, err := models.GetHostByName(hostname)
+	if err != nil {
+		exit(fmt.Errorf("failed to get host: %v", err), 1)
+	}
+
+	return h
+}
+
+func cmdTokenList(cmd *cli.Cmd) {
+	cmd.Spec = "HOSTNAME"
+	var (
+		hostname = cmd.StringArg("HOSTNAME", "", "Mainzone of the host")
+	)
+
+	cmd.Action = func() {
+		h := tokenCmdHost(*hostname)
+
+		tokens, err := models.ListTokens(h)
+		if err != nil {
+			exit(fmt.Errorf("failed to get tokens: %v", err), 1)
+		}
+
+		fmt.Printf("Tokens of %v:\n", h.Hostname)
+		fmt.Printf("---------------------\n")
+		for _, t := range tokens {
+			fmt.Printf("%v\t%v...\t%v\t%v\n", t.ID, t.Prefix, t.Scope, t.Label)
+			fmt.Printf("\tCreated:\t%v\n", t.CreatedAt)
+			if t.LastUsedAt != nil {
+				fmt.Printf("\tLast used:\t%v\n", t.LastUsedAt)
+			}
+			if t.RevokedAt != nil {
+				fmt.Printf("\tRevoked:\t%v\n", t.RevokedAt)
+			}
+		}
+	}
+}
+
+func cmdTokenCreate(cmd *cli.Cmd) {
+	cmd.Spec = "[--label] [--scope] HOSTNAME"
+	var (
+		label    = cmd.StringOpt("label", "", "Label of the token")
+		scope    = cmd.StringOpt("scope", models.ScopeFull, "Scope of the token: full, update or acme")
+		hostname = cmd.StringArg("HOSTNAME", "", "Mainzone of the host")
+	)
+
+	cmd.Action = func() {
+		h := tokenCmdHost(*hostname)
+
+		token, t, err := models.CreateToken(h, *label, *scope)
+		if err != nil {
+			exit(fmt.Errorf("failed to create token: %v", err), 1)
+		}
+
+		fmt.Println(green(CharCheck), "Token", t.ID, "created:", token)
+	}
+}
+
+func cmdTokenRotate(cmd *cli.Cmd) {
+	cmd.Spec = "HOSTNAME ID"
+	var (
+		hostname = cmd.StringArg("HOSTNAME", "", "Mainzone of the host")
+		id       = cmd.IntArg("ID", 0, "ID of the token")
+	)
+
+	cmd.Action = func() {
+		h := tokenCmdHost(*hostname)
+
+		token, t, err := models.RotateToken(h, int64(*id))
+		if err != nil {
+			exit(fmt.Errorf("failed to rotate token: %v", err), 1)
+		}
+
+		fmt.Println(green(CharCheck), "Token", *id, "replaced by token", t.ID, ":", token)
+	}
+}
+
+func cmdTokenRevoke(cmd *cli.Cmd) {
+	cmd.Spec = "HOSTNAME ID"
+	var (
+		hostname = cmd.StringArg("HOSTNAME", "", "Mainzone of the host")
+		id       = cmd.IntArg("ID", 0, "ID of the token")
+	)
+
+	cmd.Action = func() {
+		h := tokenCmdHost(*hostname)
+
+		if err := models.RevokeToken(h, int64(*id)); err != nil {
+			exit(fmt.Errorf("failed to revoke token: %v", err), 1)
+		}
+
+		fmt.Println(green(CharCheck), "Token", *id, "revoked")
+	}
+}
+
+func cmdReservedList(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		initModels()
+
+		rules, err := models.ListReservedNames()
+		if err != nil {
+			exit(fmt.Errorf("failed to get reserved names: %v", err), 1)
+		}
+
+		fmt.Printf("Reserved names:\n")
+		fmt.Printf("---------------------\n")
+		for _, r := range rules {
+			fmt.Printf("%v\t%v\t%v\t%v\n", r.ID, r.Kind, r.Pattern, r.Reason)
+		}
+	}
+}
+
+func cmdReservedAdd(cmd *cli.Cmd) {
+	cmd.Spec = "[--kind] [--reason] PATTERN"
+	var (
+		kind    = cmd.StringOpt("kind", models.ReservedExact, "Kind of the rule: exact, prefix, glob or regex")
+		reason  = cmd.StringOpt("reason", "", "Why the names are reserved")
+		pattern = cmd.StringArg("PATTERN", "", "Name or pattern to reserve")
+	)
+
+	cmd.Action = func() {
+		initModels()
+
+		r, err := models.AddReservedName(*kind, *pattern, *reason)
+		if err != nil {
+			exit(fmt.Errorf("failed to add reserved name: %v", err), 1)
+		}
+
+		fmt.Println(green(CharCheck), "Reserved name", r.ID, "added")
+	}
+}
+
+func cmdReservedDelete(cmd *cli.Cmd) {
+	cmd.Spec = "ID"
+	var (
+		id = cmd.IntArg("ID", 0, "ID of the rule")
+	)
+
+	cmd.Action = func() {
+		initModels()
+
+		if err := models.DeleteReservedName(int64(*id)); err != nil {
+			exit(fmt.Errorf("failed to delete reserved name: %v", err), 1)
+		}
+
+		fmt.Println(green(CharCheck), "Reserved name", *id, "deleted")
+	}
+}
+
+func cmdReservedCheck(cmd *cli.Cmd) {
+	cmd.Spec = "NAME"
+	var (
+		name = cmd.StringArg("NAME", "", "Name to check")
+	)
+
+	cmd.Action = func() {
+		initModels()
+
+		r, err := models.CheckReservedName(*name)
+		if err != nil {
+			exit(fmt.Errorf("failed to check name: %v", err), 1)
+		}
+
+		if r == nil {
+			fmt.Println(green(CharCheck), *name, "is not reserved")
+			return
+		}
+
+		fmt.Println(errorRed(CharAbort), *name, "is reserved by rule", r.ID, r.Kind, r.Pattern, ":", r.Reason)
+		cli.Exit(2)
+	}
 }
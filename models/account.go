@@ -0,0 +1,295 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/calaos/calaos_dns/models/orm"
+	"github.com/calaos/calaos_dns/utils"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Minimum length of the password of an account
+const minPasswordLen = 8
+
+var (
+	dummyOnce sync.Once
+	dummyHash []byte
+)
+
+// Account is a user owning several hosts. It logs in with its email and
+// password, or uses an API key.
+type Account struct {
+	ID           int64      `gorm:"primary_key" json:"id"`
+	Email        string     `gorm:"unique_index" json:"email"`
+	PasswordHash string     `json:"-"`
+	ApiKeyHash   string     `json:"-"`
+	ApiKeyPrefix string     `gorm:"index" json:"-"`
+	CreatedAt    *time.Time `gorm:"type:timestamp" json:"created_at"`
+}
+
+func normalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	at := strings.Index(email, "@")
+	if at < 1 || at == len(email)-1 || strings.ContainsAny(email, " \t,;") {
+		return "", fmt.Errorf("Invalid email")
+	}
+	return email, nil
+}
+
+// CreateAccount creates an account with email and password
+func CreateAccount(email, password string) (a *Account, err error) {
+	email, err = normalizeEmail(email)
+	if err != nil {
+		return
+	}
+
+	if len(password) < minPasswordLen {
+		return nil, fmt.Errorf("Password must have at least %d characters", minPasswordLen)
+	}
+
+	if !db.Where("email = ?", email).First(&Account{}).RecordNotFound() {
+		return nil, fmt.Errorf("Email already registered")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Println("Unable to hash password:", err)
+		return nil, fmt.Errorf("Internal error")
+	}
+
+	log.Println("Creating account", email)
+
+	a = &Account{
+		Email:        email,
+		PasswordHash: string(hash),
+	}
+	if err = orm.Create(db, a); err != nil {
+		log.Println("Unable to add account to DB:", err)
+		return nil, fmt.Errorf("Internal error")
+	}
+
+	return
+}
+
+// Login returns the account of email if password is right
+func Login(email, password string) (a *Account, err error) {
+	email, err = normalizeEmail(email)
+	if err != nil {
+		return nil, fmt.Errorf("Wrong email or password")
+	}
+
+	a = &Account{}
+	if db.Where("email = ?", email).First(a).RecordNotFound() {
+		//Spend the same time as for a wrong password
+		dummyOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte(utils.TokenGenerator()), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, fmt.Errorf("Wrong email or password")
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(a.PasswordHash), []byte(password)) != nil {
+		log.Println("Wrong password for account", email)
+		return nil, fmt.Errorf("Wrong email or password")
+	}
+
+	return
+}
+
+// GetAccount returns the account id
+func GetAccount(id int64) (a *Account, err error) {
+	a = &Account{}
+	if err = db.First(a, id).Error; err != nil {
+		return nil, fmt.Errorf("Unknown account")
+	}
+	return
+}
+
+// GetAccountByApiKey returns the account of the API key key
+func GetAccountByApiKey(key string) (a *Account, err error) {
+	if len(key) >= utils.TokenPrefixLen {
+		var accounts []Account
+		err = db.Where("api_key_prefix = ?", utils.TokenPrefix(key)).Find(&accounts).Error
+		if err == nil {
+			for i := range accounts {
+				if utils.VerifyToken(key, accounts[i].ApiKeyHash) {
+					return &accounts[i], nil
+				}
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("Unknown API key")
+}
+
+// CreateApiKey generates a new API key for the account. The previous key
+// stops working.
+func CreateApiKey(a *Account) (key string, err error) {
+	key = utils.TokenGenerator()
+
+	log.Println("Creating API key of account", a.Email)
+
+	err = db.Model(a).UpdateColumns(map[string]interface{}{
+		"api_key_hash":   utils.HashToken(key),
+		"api_key_prefix": utils.TokenPrefix(key),
+	}).Error
+	if err != nil {
+		log.Println("Unable to save API key:", err)
+		return "", fmt.Errorf("Internal error")
+	}
+
+	return
+}
+
+// AccountHosts returns the hosts owned by the account
+func AccountHosts(a *Account) (hosts []Host, err error) {
+	err = db.Where("account_id = ?", a.ID).Order("hostname").Find(&hosts).Error
+	if err != nil {
+		log.Println("Unable to query hosts from DB:", err)
+		return nil, fmt.Errorf("Internal error")
+	}
+	return
+}
+
+// AccountHost returns the host hostname if it is owned by the account
+func AccountHost(a *Account, hostname string) (h *Host, err error) {
+	h, err = GetHostByName(hostname)
+	if err != nil || h.AccountID != a.ID {
+		return nil, ErrUnknownHost
+	}
+	return
+}
+
+// RegisterAccountHost registers a new host owned by the account. The token
+// of the host is returned for its box.
+func RegisterAccountHost(a *Account, mainzone, subzone, ip, ipv6, source string) (token string, err error) {
+	log.Println("Account", a.Email, "registers host", mainzone)
+
+	err, token = registerDns(mainzone, subzone, "", ip, ipv6, source, a.ID)
+	return
+}
+
+// managedHost returns the host hostname of the account if it can be changed
+func managedHost(a *Account, hostname string) (h *Host, err error) {
+	h, err = AccountHost(a, hostname)
+	if err != nil {
+		return
+	}
+
+	if h.Suspended() {
+		return nil, ErrHostSuspended
+	}
+
+	return
+}
+
+// DeleteAccountHost deletes the host hostname of the account
+func DeleteAccountHost(a *Account, hostname string) (err error) {
+	h, err := managedHost(a, hostname)
+	if err != nil {
+		return
+	}
+
+	log.Println("Account", a.Email, "deletes host", hostname)
+
+	if err = deleteHost(h); err != nil {
+		return fmt.Errorf("Internal error")
+	}
+
+	return
+}
+
+// UpdateAccountHost changes the addresses of the host hostname of the account
+func UpdateAccountHost(a *Account, hostname, ip, ipv6 string) (h *Host, err error) {
+	h, err = managedHost(a, hostname)
+	if err != nil {
+		return
+	}
+
+	err = updateAddresses(h, ip, ipv6)
+	return
+}
+
+// CreateAccountHostToken adds a token to the host hostname of the account
+func CreateAccountHostToken(a *Account, hostname, label, scope string) (token string, t *Token, err error) {
+	h, err := managedHost(a, hostname)
+	if err != nil {
+		return
+	}
+
+	return CreateToken(h, label, scope)
+}
+
+// ClaimHost adds the host of the full token token to the account
+func ClaimHost(a *Account, token string) (h *Host, err error) {
+	h, err = GetHostByToken(token, ScopeFull)
+	if err != nil {
+		return
+	}
+
+	if h.AccountID != 0 && h.AccountID != a.ID {
+		return nil, fmt.Errorf("Host is owned by another account")
+	}
+
+	err = setHostAccount(h, a)
+	return
+}
+
+// TransferHost gives the host hostname of the account to the account of
+// email
+func TransferHost(a *Account, hostname, email string) (h *Host, err error) {
+	if email == "" {
+		return nil, fmt.Errorf("Invalid email")
+	}
+
+	h, err = managedHost(a, hostname)
+	if err != nil {
+		return
+	}
+
+	return h, SetHostOwner(h, email)
+}
+
+// SetHostOwner gives the host to the account of email, or makes it
+// anonymous again if email is empty
+func SetHostOwner(h *Host, email string) (err error) {
+	if email == "" {
+		return setHostAccount(h, nil)
+	}
+
+	email, err = normalizeEmail(email)
+	if err != nil {
+		return
+	}
+
+	to := &Account{}
+	if db.Where("email = ?", email).First(to).RecordNotFound() {
+		return fmt.Errorf("Unknown account")
+	}
+
+	return setHostAccount(h, to)
+}
+
+func setHostAccount(h *Host, a *Account) error {
+	var id int64
+	owner := "<none>"
+	if a != nil {
+		id = a.ID
+		owner = a.Email
+	}
+
+	log.Println("Setting owner of host", h.Hostname, "to", owner)
+
+	if err := db.Model(h).UpdateColumn("account_id", id).Error; err != nil {
+		log.Println("Unable to save host:", err)
+		return fmt.Errorf("Internal error")
+	}
+	h.AccountID = id
+
+	return nil
+}
@@ -0,0 +1,220 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/calaos/calaos_dns/backend"
+	"github.com/calaos/calaos_dns/config"
+	"github.com/calaos/calaos_dns/models/orm"
+	"github.com/calaos/calaos_dns/utils"
+
+	"github.com/jinzhu/gorm"
+)
+
+// AcmeChallenge is an outstanding letsencrypt DNS-01 challenge value. All
+// values of a name are published together in its TXT RRset so that several
+// validations (wildcard and base name, parallel orders) can run at once.
+type AcmeChallenge struct {
+	ID        int64      `gorm:"primary_key" json:"-"`
+	HostID    int64      `gorm:"index" json:"-"`
+	Name      string     `gorm:"index" json:"name"`
+	Value     string     `json:"value"`
+	CreatedAt *time.Time `gorm:"type:timestamp" json:"created_at,omitempty"`
+}
+
+// acmeName returns the _acme-challenge record name of leDomain, which is
+// either the mainzone of the host or one of its subzones
+func acmeName(h *Host, leDomain string) (name string, err error) {
+	subs := strings.Split(h.Subzones, ",")
+	if leDomain != h.Hostname && !utils.StringInSlice(leDomain, subs) {
+		log.Println("Wrong domain, not registered for user")
+		return "", fmt.Errorf("Wrong domain")
+	}
+
+	z := leDomain + "." + config.Conf.Powerdns.Zone
+	if leDomain != h.Hostname { //It's a subdomain
+		z = leDomain + "." + h.Hostname + "." + config.Conf.Powerdns.Zone
+	}
+
+	return "_acme-challenge." + z, nil
+}
+
+// addChallenge publishes value in the TXT RRset of name along with the other
+// outstanding values
+func addChallenge(h *Host, name, value string) error {
+	return commitChallenges([]string{name}, func(tx *gorm.DB) error {
+		c := AcmeChallenge{HostID: h.ID, Name: name, Value: value}
+		if !tx.Where(&c).First(&AcmeChallenge{}).RecordNotFound() {
+			return nil
+		}
+		return tx.Create(&c).Error
+	})
+}
+
+// removeChallenges removes value from the TXT RRset of name, or all values of
+// the host for name if value is empty
+func removeChallenges(h *Host, name, value string) error {
+	return commitChallenges([]string{name}, func(tx *gorm.DB) error {
+		q := tx.Where("host_id = ? AND name = ?", h.ID, name)
+		if value != "" {
+			q = q.Where("value = ?", value)
+		}
+		return q.Delete(AcmeChallenge{}).Error
+	})
+}
+
+// challengeValues returns the outstanding challenge values of name
+func challengeValues(tx *gorm.DB, name string) (values []string, err error) {
+	var challenges []AcmeChallenge
+	err = tx.Where("name = ?", name).Order("id").Find(&challenges).Error
+	if err != nil {
+		return
+	}
+
+	for _, c := range challenges {
+		values = append(values, c.Value)
+	}
+
+	return
+}
+
+// challengeRecords returns the TXT records built from the challenges stored
+// in the DB. If name is not empty, only the records of that name are returned.
+func challengeRecords(name string) (records []backend.Record, err error) {
+	var challenges []AcmeChallenge
+	q := db.Order("id")
+	if name != "" {
+		q = q.Where("name = ?", name)
+	}
+	if err = q.Find(&challenges).Error; err != nil {
+		return
+	}
+
+	byName := make(map[string]int)
+	for _, c := range challenges {
+		i, ok := byName[c.Name]
+		if !ok {
+			i = len(records)
+			byName[c.Name] = i
+			records = append(records, backend.Record{Name: c.Name, Type: backend.TypeTXT, TTL: recordTTL})
+		}
+		records[i].Content = append(records[i].Content, quoteTxt(c.Value))
+	}
+
+	return
+}
+
+func quoteTxt(value string) string {
+	return "\"" + value + "\""
+}
+
+var challengeLocks = newNameLocks()
+
+// lockChallenges locks the challenges of all names until unlock is called
+func lockChallenges(names []string) (unlock func()) {
+	return challengeLocks.lock(names)
+}
+
+// commitChallenges runs dbFn and then publishes the TXT RRset of each name
+// with all its outstanding values, or removes it if none is left. The DB
+// transaction is rolled back if the DNS backend fails.
+//
+// The RRset is rebuilt from the values seen by the transaction. The changes
+// of a name are serialized, otherwise two concurrent transactions would each
+// only see their own new value and the last one published would drop the
+// other.
+func commitChallenges(names []string, dbFn func(tx *gorm.DB) error) (err error) {
+	unlock := lockChallenges(names)
+	defer unlock()
+
+	err = orm.Transaction(db, func(tx *gorm.DB) error {
+		if err := dbFn(tx); err != nil {
+			log.Println("Unable to update challenges in DB:", err)
+			return err
+		}
+
+		var changes []backend.Change
+		for _, name := range names {
+			values, err := challengeValues(tx, name)
+			if err != nil {
+				log.Println("Unable to read challenges from DB:", err)
+				return err
+			}
+
+			if len(values) == 0 {
+				changes = append(changes, backend.Delete(name, backend.TypeTXT))
+				continue
+			}
+
+			var content []string
+			for _, v := range values {
+				content = append(content, quoteTxt(v))
+			}
+			changes = append(changes, backend.Upsert(name, backend.TypeTXT, recordTTL, content))
+		}
+
+		if len(changes) == 0 {
+			return nil
+		}
+
+		if err := dnsBackend.Apply(context.Background(), changes); err != nil {
+			log.Println("Unable to apply changes to DNS backend:", err)
+			return err
+		}
+
+		return nil
+	})
+
+	if err == nil && len(names) > 0 {
+		zoneChanged()
+	}
+
+	return
+}
+
+// removeExpiredChallenges is run by the cron to remove the challenges that
+// were left behind by a client, e.g. when it crashed during the validation
+func removeExpiredChallenges() {
+	lifetime := time.Duration(config.Conf.General.ChallengeLifetimeHours) * time.Hour
+	if lifetime <= 0 {
+		lifetime = 24 * time.Hour
+	}
+
+	var challenges []AcmeChallenge
+	err := db.Where("created_at < ?", time.Now().Add(-lifetime)).Find(&challenges).Error
+	if err != nil {
+		log.Println("Unable to query challenges from DB:", err)
+		return
+	}
+
+	if len(challenges) == 0 {
+		return
+	}
+
+	var ids []int64
+	var names []string
+	for _, c := range challenges {
+		hostname := "<deleted>"
+		var h Host
+		if db.First(&h, c.HostID).Error == nil {
+			hostname = h.Hostname
+		}
+		log.Println("Challenge", c.Name, c.Value, "left by host", hostname, "has expired.")
+
+		ids = append(ids, c.ID)
+		if !utils.StringInSlice(c.Name, names) {
+			names = append(names, c.Name)
+		}
+	}
+
+	err = commitChallenges(names, func(tx *gorm.DB) error {
+		return tx.Where("id IN (?)", ids).Delete(AcmeChallenge{}).Error
+	})
+	if err != nil {
+		log.Println("Unable to remove expired challenges:", err)
+	}
+}
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/calaos/calaos_dns/backend"
+)
+
+// TestConcurrentChallenges presents several values of the same name at once,
+// as lego does for a domain and its wildcard. No value may be dropped from
+// the published RRset.
+//
+// sqlite serializes the transactions by itself, run it against MySQL with
+// CALAOS_DNS_TEST_DB_TYPE and CALAOS_DNS_TEST_DB_DSN to check the locking of
+// the challenges under REPEATABLE READ.
+func TestConcurrentChallenges(t *testing.T) {
+	mem := setupTest(t)
+
+	token := register(t, "myhome", "", "1.2.3.4", "")
+
+	const count = 8
+	var want []string
+	for i := 0; i < count; i++ {
+		want = append(want, fmt.Sprintf(`"value%d"`, i))
+	}
+
+	start := make(chan struct{})
+	errs := make(chan error, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			errs <- AddLeRecord(token, "myhome", fmt.Sprintf("value%d", i))
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := records(t, mem, "_acme-challenge.myhome.calaos.fr", backend.TypeTXT)
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("published %v, want %v", got, want)
+	}
+}
+
+func TestLockChallenges(t *testing.T) {
+	unlock := lockChallenges([]string{"b", "a", "b"})
+
+	done := make(chan struct{})
+	go func() {
+		unlock := lockChallenges([]string{"a"})
+		unlock()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("name locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	<-done
+
+	challengeLocks.mutex.Lock()
+	defer challengeLocks.mutex.Unlock()
+	if len(challengeLocks.names) != 0 {
+		t.Errorf("%v names still locked", len(challengeLocks.names))
+	}
+}
+
+// TestSuspendLocksChallenges checks that a suspension waits for a challenge
+// being published, and then removes it
+func TestSuspendLocksChallenges(t *testing.T) {
+	mem := setupTest(t)
+
+	token := register(t, "myhome", "", "1.2.3.4", "")
+	if err := AddLeRecord(token, "myhome", "value1"); err != nil {
+		t.Fatal(err)
+	}
+
+	name := "_acme-challenge.myhome.calaos.fr"
+	unlock := lockChallenges([]string{name})
+
+	done := make(chan error)
+	go func() {
+		_, err := SuspendHost("myhome")
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("host suspended while its challenges are locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	checkRecords(t, mem, name, backend.TypeTXT)
+}
@@ -0,0 +1,216 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/calaos/calaos_dns/config"
+	"github.com/calaos/calaos_dns/models/orm"
+	"github.com/calaos/calaos_dns/utils"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Errors of the acme-dns protocol
+var (
+	ErrAcmeDnsForbidden    = errors.New("forbidden")
+	ErrAcmeDnsBadSubdomain = errors.New("bad_subdomain")
+	ErrAcmeDnsBadTxt       = errors.New("bad_txt")
+	ErrAcmeDnsBadAllowFrom = errors.New("invalid_allowfrom_cidr")
+)
+
+// acme-dns publishes the two last values so that a wildcard and its base
+// name can be validated together
+const acmeDnsValues = 2
+
+// AcmeDnsAccount is the acme-dns account of a host. The host has no address,
+// its subdomain only serves the TXT records that clients CNAME their
+// _acme-challenge names to. The password of the account is the host token.
+type AcmeDnsAccount struct {
+	ID        int64      `gorm:"primary_key"`
+	HostID    int64      `gorm:"unique_index"`
+	Username  string     `gorm:"unique_index"`
+	AllowFrom string     //comma separated CIDRs allowed to update, any if empty
+	CreatedAt *time.Time `gorm:"type:timestamp"`
+}
+
+// AcmeDnsRegistration is the answer to an acme-dns registration
+type AcmeDnsRegistration struct {
+	Username   string   `json:"username"`
+	Password   string   `json:"password"`
+	Fulldomain string   `json:"fulldomain"`
+	Subdomain  string   `json:"subdomain"`
+	AllowFrom  []string `json:"allowfrom"`
+}
+
+var acmeDnsTxt = regexp.MustCompile("^[A-Za-z0-9_-]{43}$")
+
+// RegisterAcmeDns creates a host with a random subdomain for an acme-dns
+// client. Only addresses in allowFrom can update it if not empty. source is
+// the address of the client.
+func RegisterAcmeDns(allowFrom []string, source string) (reg *AcmeDnsRegistration, err error) {
+	var cidrs []string
+	for _, a := range allowFrom {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(a))
+		if err != nil {
+			return nil, ErrAcmeDnsBadAllowFrom
+		}
+		cidrs = append(cidrs, n.String())
+	}
+
+	if err = checkHostsPerIP(db, source); err != nil {
+		return
+	}
+
+	username := utils.UUIDGenerator()
+	h := Host{
+		Hostname: strings.Replace(utils.UUIDGenerator(), "-", "", -1),
+	}
+	var password string
+
+	log.Println("Register new acme-dns account:", username, h.Hostname, cidrs)
+
+	err = orm.Transaction(db, func(tx *gorm.DB) error {
+		if err := tx.Create(&h).Error; err != nil {
+			return err
+		}
+
+		if err := addRegistration(tx, source, h.Hostname); err != nil {
+			return err
+		}
+
+		var err error
+		password, _, err = createToken(tx, h.ID, "acme-dns", ScopeAcme)
+		if err != nil {
+			return err
+		}
+
+		a := AcmeDnsAccount{
+			HostID:    h.ID,
+			Username:  username,
+			AllowFrom: strings.Join(cidrs, ","),
+		}
+		return tx.Create(&a).Error
+	})
+	if err != nil {
+		log.Println("Failed to add acme-dns account to DB:", err)
+		return
+	}
+
+	if cidrs == nil {
+		cidrs = []string{}
+	}
+
+	reg = &AcmeDnsRegistration{
+		Username:   username,
+		Password:   password,
+		Fulldomain: h.Hostname + "." + config.Conf.Powerdns.Zone,
+		Subdomain:  h.Hostname,
+		AllowFrom:  cidrs,
+	}
+
+	return
+}
+
+// UpdateAcmeDns publishes txt on the subdomain of the acme-dns account. The
+// request is refused if ip is not in the allowed networks of the account.
+func UpdateAcmeDns(username, password, subdomain, txt, ip string) (err error) {
+	h, err := GetHostByToken(password, ScopeAcme)
+	if err != nil {
+		return ErrAcmeDnsForbidden
+	}
+
+	return UpdateAcmeDnsHost(h, username, subdomain, txt, ip)
+}
+
+// UpdateAcmeDnsHost is UpdateAcmeDns for the host h found by VerifyRequest
+// with the password of the account
+func UpdateAcmeDnsHost(h *Host, username, subdomain, txt, ip string) (err error) {
+	var a AcmeDnsAccount
+	if db.Where("username = ?", username).First(&a).RecordNotFound() || h.ID != a.HostID {
+		return ErrAcmeDnsForbidden
+	}
+
+	if subdomain != h.Hostname {
+		if _, valid := utils.IsValidHostname(subdomain); !valid {
+			return ErrAcmeDnsBadSubdomain
+		}
+		return ErrAcmeDnsForbidden
+	}
+
+	if !allowedFrom(a.AllowFrom, ip) {
+		log.Println("acme-dns update of", subdomain, "refused from", ip)
+		return ErrAcmeDnsForbidden
+	}
+
+	if !acmeDnsTxt.MatchString(txt) {
+		return ErrAcmeDnsBadTxt
+	}
+
+	name := h.Zones()[0]
+
+	err = commitChallenges([]string{name}, func(tx *gorm.DB) error {
+		c := AcmeChallenge{HostID: h.ID, Name: name, Value: txt}
+		if err := tx.Create(&c).Error; err != nil {
+			return err
+		}
+
+		//Only keep the last values
+		var all []AcmeChallenge
+		err := tx.Where("name = ?", name).Order("id desc").Find(&all).Error
+		if err != nil || len(all) <= acmeDnsValues {
+			return err
+		}
+
+		var ids []int64
+		for _, o := range all[acmeDnsValues:] {
+			ids = append(ids, o.ID)
+		}
+		return tx.Where("id IN (?)", ids).Delete(AcmeChallenge{}).Error
+	})
+	if err != nil {
+		log.Println("Unable to update acme-dns record of", subdomain, ":", err)
+	}
+
+	return
+}
+
+// allowedFrom returns true if ip is in one of the comma separated CIDRs
+func allowedFrom(allowFrom, ip string) bool {
+	if allowFrom == "" {
+		return true
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	for _, c := range strings.Split(allowFrom, ",") {
+		_, n, err := net.ParseCIDR(c)
+		if err == nil && n.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// acmeDnsHosts returns the IDs of the hosts of acme-dns accounts
+func acmeDnsHosts() (ids map[int64]bool, err error) {
+	var accounts []AcmeDnsAccount
+	if err = orm.FindAll(db, &accounts); err != nil {
+		return
+	}
+
+	ids = make(map[int64]bool)
+	for _, a := range accounts {
+		ids[a.HostID] = true
+	}
+
+	return
+}
@@ -0,0 +1,243 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/calaos/calaos_dns/backend"
+	"github.com/calaos/calaos_dns/config"
+	"github.com/calaos/calaos_dns/utils"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ErrHostSuspended is returned when the owner of a suspended host uses it
+var ErrHostSuspended = fmt.Errorf("Host is suspended, contact the administrator")
+
+// HostDetails is a host as shown to the admins
+type HostDetails struct {
+	Host
+	Zones     []string   `json:"zones"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Owner     string     `json:"owner,omitempty"`
+	Records   []string   `json:"records,omitempty"`
+}
+
+// HostPage is a page of the hosts matching a search
+type HostPage struct {
+	Total   int           `json:"total"`
+	Page    int           `json:"page"`
+	PerPage int           `json:"per_page"`
+	Hosts   []HostDetails `json:"hosts"`
+}
+
+// NewHostDetails returns the details of the host. The records published by
+// the DNS backend and the owner are only read if withRecords is set.
+func NewHostDetails(h *Host, withRecords bool) *HostDetails {
+	d := &HostDetails{
+		Host:  *h,
+		Zones: h.Zones(),
+	}
+
+	if h.UpdatedAt != nil {
+		expires := h.UpdatedAt.AddDate(0, 0, config.Conf.General.ExpirationDays)
+		d.ExpiresAt = &expires
+	}
+
+	if withRecords {
+		d.Records = GetPdnsRecords(h)
+
+		if h.AccountID != 0 {
+			if a, err := GetAccount(h.AccountID); err == nil {
+				d.Owner = a.Email
+			}
+		}
+	}
+
+	return d
+}
+
+// SearchHosts returns a page of the hosts whose name, subzones or addresses
+// contain query, all hosts if query is empty. Pages start at 1.
+func SearchHosts(query string, page, perPage int) (result *HostPage, err error) {
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 || perPage > 500 {
+		perPage = 50
+	}
+
+	q := db.Model(&Host{})
+	if query != "" {
+		like := "%" + query + "%"
+		q = q.Where("hostname LIKE ? OR subzones LIKE ? OR ip LIKE ? OR ipv6 LIKE ?", like, like, like, like)
+	}
+
+	result = &HostPage{
+		Page:    page,
+		PerPage: perPage,
+		Hosts:   []HostDetails{},
+	}
+
+	if err = q.Count(&result.Total).Error; err != nil {
+		log.Println("Unable to count hosts in DB:", err)
+		return nil, fmt.Errorf("Internal error")
+	}
+
+	var hosts []Host
+	err = q.Order("hostname").Offset((page - 1) * perPage).Limit(perPage).Find(&hosts).Error
+	if err != nil {
+		log.Println("Unable to query hosts from DB:", err)
+		return nil, fmt.Errorf("Internal error")
+	}
+
+	for i := range hosts {
+		result.Hosts = append(result.Hosts, *NewHostDetails(&hosts[i], false))
+	}
+
+	return
+}
+
+// DeleteHost deletes the host hostname and all its records
+func DeleteHost(hostname string) (err error) {
+	h, err := GetHostByName(hostname)
+	if err != nil {
+		return
+	}
+
+	log.Println("Deleting host", hostname)
+
+	if err = deleteHost(h); err != nil {
+		return fmt.Errorf("Internal error")
+	}
+
+	return
+}
+
+// SetHostAddresses changes the addresses of the host hostname
+func SetHostAddresses(hostname, ip, ipv6 string) (h *Host, err error) {
+	h, err = GetHostByName(hostname)
+	if err != nil {
+		return
+	}
+
+	if ip == "" && ipv6 == "" {
+		return nil, fmt.Errorf("Invalid IP address")
+	}
+
+	log.Println("Changing addresses of host", hostname, "to", ip, ipv6)
+
+	err = updateAddresses(h, ip, ipv6)
+	return
+}
+
+// ExpireHost marks the host hostname as expired. It is removed by the next
+// run of the expiration job unless its owner updates it before.
+func ExpireHost(hostname string) (h *Host, err error) {
+	h, err = GetHostByName(hostname)
+	if err != nil {
+		return
+	}
+
+	log.Println("Forcing expiration of host", hostname)
+
+	expired := time.Now().AddDate(0, 0, -config.Conf.General.ExpirationDays-1)
+	if err = db.Model(h).UpdateColumn("updated_at", expired).Error; err != nil {
+		log.Println("Unable to save host:", err)
+		return nil, fmt.Errorf("Internal error")
+	}
+	h.UpdatedAt = &expired
+
+	return
+}
+
+// SuspendHost suspends the host hostname. Its records are replaced by the
+// parking addresses, its challenges are removed from the zone and its owner
+// can't update it anymore. The host does not expire while it is suspended.
+func SuspendHost(hostname string) (h *Host, err error) {
+	h, err = GetHostByName(hostname)
+	if err != nil {
+		return
+	}
+
+	if h.Suspended() {
+		return nil, fmt.Errorf("Host already suspended")
+	}
+
+	//No challenge of the host is added or removed until the suspension is
+	//committed
+	unlock := lockChallenges(h.challengeNames())
+	defer unlock()
+
+	var challenges []AcmeChallenge
+	if err = db.Where("host_id = ?", h.ID).Find(&challenges).Error; err != nil {
+		log.Println("Unable to query challenges from DB:", err)
+		return nil, fmt.Errorf("Internal error")
+	}
+
+	parkingIP, parkingIPv6 := parkingAddresses()
+
+	var changes []backend.Change
+	for _, z := range h.Zones() {
+		changes = append(changes, addressChanges(z, parkingIP, parkingIPv6)...)
+	}
+
+	var names []string
+	for _, c := range challenges {
+		if !utils.StringInSlice(c.Name, names) {
+			names = append(names, c.Name)
+			changes = append(changes, backend.Delete(c.Name, backend.TypeTXT))
+		}
+	}
+
+	log.Println("Suspending host", hostname)
+
+	now := time.Now()
+	err = commitChanges(context.Background(), changes, func(tx *gorm.DB) error {
+		if err := tx.Where("host_id = ?", h.ID).Delete(AcmeChallenge{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(h).UpdateColumn("suspended_at", now).Error
+	})
+	if err != nil {
+		log.Println("Unable to suspend host:", err)
+		return nil, fmt.Errorf("Internal error")
+	}
+	h.SuspendedAt = &now
+
+	return
+}
+
+// UnsuspendHost publishes again the last addresses of the suspended host
+// hostname
+func UnsuspendHost(hostname string) (h *Host, err error) {
+	h, err = GetHostByName(hostname)
+	if err != nil {
+		return
+	}
+
+	if !h.Suspended() {
+		return nil, fmt.Errorf("Host is not suspended")
+	}
+
+	var changes []backend.Change
+	for _, z := range h.Zones() {
+		changes = append(changes, addressChanges(z, h.IP, h.IPv6)...)
+	}
+
+	log.Println("Unsuspending host", hostname)
+
+	//The suspension does not count in the expiration of the host
+	err = commitChanges(context.Background(), changes, func(tx *gorm.DB) error {
+		return tx.Model(h).Updates(map[string]interface{}{"suspended_at": nil, "updated_at": time.Now()}).Error
+	})
+	if err != nil {
+		log.Println("Unable to unsuspend host:", err)
+		return nil, fmt.Errorf("Internal error")
+	}
+	h.SuspendedAt = nil
+
+	return
+}
@@ -0,0 +1,498 @@
+package models
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/calaos/calaos_dns/backend"
+	"github.com/calaos/calaos_dns/config"
+	"github.com/calaos/calaos_dns/models/orm"
+	"github.com/calaos/calaos_dns/utils"
+
+	"github.com/go-acme/lego/certcrypto"
+	"github.com/go-acme/lego/certificate"
+	"github.com/go-acme/lego/challenge/dns01"
+	"github.com/go-acme/lego/lego"
+	"github.com/go-acme/lego/registration"
+)
+
+// Status of the certificate of a host
+const (
+	CertPending = "pending" //issuance or renewal is running
+	CertValid   = "valid"   //last issuance succeeded
+	CertFailed  = "failed"  //last issuance failed, a previous certificate may still be available
+)
+
+// Certificate is the certificate issued for a host and its subzones. The
+// certificate and its private key are stored encrypted.
+type Certificate struct {
+	ID        int64      `gorm:"primary_key"`
+	HostID    int64      `gorm:"unique_index"`
+	Domains   string     //comma separated names of the certificate
+	Status    string     //one of CertPending, CertValid or CertFailed
+	Error     string     `gorm:"type:text"`
+	Cert      []byte     `gorm:"type:blob"` //encrypted PEM bundle
+	Key       []byte     `gorm:"type:blob"` //encrypted PEM private key
+	NotAfter  *time.Time //expiration of the certificate
+	Failures  int        //issuances that failed in a row
+	NextTry   *time.Time //no new issuance before this date after a failure
+	CreatedAt *time.Time `gorm:"type:timestamp"`
+	UpdatedAt *time.Time `gorm:"type:timestamp"`
+}
+
+// CertificateBundle is the certificate of a host as downloaded by the box
+type CertificateBundle struct {
+	Status      string     `json:"status"`
+	Domains     []string   `json:"domains"`
+	NotAfter    *time.Time `json:"not_after,omitempty"`
+	Certificate string     `json:"certificate,omitempty"`
+	PrivateKey  string     `json:"private_key,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// AcmeAccount is the account used to issue the certificates on an ACME
+// directory
+type AcmeAccount struct {
+	ID           int64  `gorm:"primary_key"`
+	Directory    string `gorm:"index"`
+	Email        string
+	Key          []byte `gorm:"type:blob"` //encrypted PEM private key
+	Registration string `gorm:"type:text"` //json of registration.Resource
+}
+
+// acmeUser implements registration.User for lego
+type acmeUser struct {
+	email        string
+	registration *registration.Resource
+	key          crypto.PrivateKey
+}
+
+func (u *acmeUser) GetEmail() string                        { return u.email }
+func (u *acmeUser) GetRegistration() *registration.Resource { return u.registration }
+func (u *acmeUser) GetPrivateKey() crypto.PrivateKey        { return u.key }
+
+// hostProvider publishes the DNS-01 challenges of a host with the same
+// records as the letsencrypt API
+type hostProvider struct {
+	h *Host
+}
+
+func (p *hostProvider) Present(domain, token, keyAuth string) error {
+	fqdn, value := dns01.GetRecord(domain, keyAuth)
+	return addChallenge(p.h, backend.CanonicalName(fqdn), value)
+}
+
+func (p *hostProvider) CleanUp(domain, token, keyAuth string) error {
+	fqdn, value := dns01.GetRecord(domain, keyAuth)
+	return removeChallenges(p.h, backend.CanonicalName(fqdn), value)
+}
+
+// Timeout leaves time to the secondaries to get the challenges
+func (p *hostProvider) Timeout() (timeout, interval time.Duration) {
+	return 5 * time.Minute, 5 * time.Second
+}
+
+var (
+	certLock sync.Mutex
+	issuing  = make(map[int64]bool)
+)
+
+// Delay before the next issuance after a failure, doubled at each new
+// failure up to certMaxBackoff
+const (
+	certBackoff    = 12 * time.Hour
+	certMaxBackoff = 7 * 24 * time.Hour
+)
+
+// failureBackoff returns the delay before retrying after failures issuances
+// failed in a row
+func failureBackoff(failures int) time.Duration {
+	d := certBackoff
+	for i := 1; i < failures && d < certMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > certMaxBackoff {
+		d = certMaxBackoff
+	}
+	return d
+}
+
+// renewLimit returns the date before which a certificate must be renewed
+func renewLimit() time.Time {
+	days := config.Conf.Certificates.RenewDays
+	if days <= 0 {
+		days = 30
+	}
+	return time.Now().AddDate(0, 0, days)
+}
+
+// needsIssuance returns nil if a new certificate can be issued for h,
+// otherwise the reason why it is refused. c is the current certificate of
+// h, nil if it has none. No certificate is issued for a suspended host.
+func needsIssuance(c *Certificate, h *Host) error {
+	if h.Suspended() {
+		return ErrHostSuspended
+	}
+
+	if c == nil {
+		return nil
+	}
+
+	if c.NextTry != nil && time.Now().Before(*c.NextTry) {
+		return fmt.Errorf("Certificate issuance failed, next try after %v", c.NextTry.Format(time.RFC3339))
+	}
+
+	if c.NotAfter != nil && c.NotAfter.After(renewLimit()) && c.Domains == strings.Join(h.Zones(), ",") {
+		return fmt.Errorf("Certificate is valid until %v", c.NotAfter.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+func certificatesEnabled() error {
+	if config.Conf.Certificates.EncryptionKey == "" {
+		return fmt.Errorf("Certificate issuance is disabled")
+	}
+	return nil
+}
+
+// acmeAccount returns the account registered on the directory, the account
+// is created if needed
+func acmeAccount(directory string) (user *acmeUser, err error) {
+	secret := config.Conf.Certificates.EncryptionKey
+	user = &acmeUser{
+		email: config.Conf.Certificates.Email,
+	}
+
+	var a AcmeAccount
+	if db.Where("directory = ?", directory).First(&a).RecordNotFound() {
+		user.key, err = certcrypto.GeneratePrivateKey(certcrypto.EC256)
+		if err != nil {
+			return
+		}
+
+		a.Directory = directory
+		a.Email = user.email
+		a.Key, err = utils.Encrypt(secret, certcrypto.PEMEncode(user.key))
+		if err != nil {
+			return
+		}
+
+		err = orm.Create(db, &a)
+		return
+	}
+
+	pemKey, err := utils.Decrypt(secret, a.Key)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt ACME account key: %v", err)
+	}
+
+	user.key, err = certcrypto.ParsePEMPrivateKey(pemKey)
+	if err != nil {
+		return
+	}
+
+	if a.Registration != "" {
+		user.registration = &registration.Resource{}
+		err = json.Unmarshal([]byte(a.Registration), user.registration)
+	}
+
+	return
+}
+
+// newAcmeClient returns a lego client with a registered account
+func newAcmeClient() (client *lego.Client, err error) {
+	directory := config.Conf.Certificates.Directory
+	if directory == "" {
+		directory = lego.LEDirectoryProduction
+	}
+
+	user, err := acmeAccount(directory)
+	if err != nil {
+		log.Println("Unable to load ACME account:", err)
+		return
+	}
+
+	c := lego.NewConfig(user)
+	c.CADirURL = directory
+
+	client, err = lego.NewClient(c)
+	if err != nil {
+		log.Println("Unable to create ACME client for", directory, ":", err)
+		return
+	}
+
+	if user.registration == nil {
+		user.registration, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+		if err != nil {
+			log.Println("Unable to register ACME account on", directory, ":", err)
+			return
+		}
+
+		var reg []byte
+		reg, err = json.Marshal(user.registration)
+		if err != nil {
+			return
+		}
+
+		err = db.Model(&AcmeAccount{}).Where("directory = ?", directory).Update("registration", string(reg)).Error
+	}
+
+	return
+}
+
+// issueCertificate obtains a certificate for all names of the host and
+// stores it encrypted in DB
+func issueCertificate(h *Host) (err error) {
+	certLock.Lock()
+	if issuing[h.ID] {
+		certLock.Unlock()
+		return fmt.Errorf("Certificate issuance already running")
+	}
+	issuing[h.ID] = true
+	certLock.Unlock()
+
+	defer func() {
+		certLock.Lock()
+		delete(issuing, h.ID)
+		certLock.Unlock()
+	}()
+
+	var c Certificate
+	db.Where("host_id = ?", h.ID).First(&c)
+	c.HostID = h.ID
+	c.Domains = strings.Join(h.Zones(), ",")
+	c.Status = CertPending
+	c.Error = ""
+	if err = db.Save(&c).Error; err != nil {
+		log.Println("Unable to save certificate in DB:", err)
+		return
+	}
+
+	err = obtainCertificate(h, &c)
+	if err != nil {
+		c.Status = CertFailed
+		c.Error = err.Error()
+		c.Failures++
+		next := time.Now().Add(failureBackoff(c.Failures))
+		c.NextTry = &next
+		log.Println("Unable to issue certificate for", h.Hostname, ":", err, ", next try after", next)
+	} else {
+		log.Println("Certificate issued for", c.Domains, "valid until", c.NotAfter)
+		c.Status = CertValid
+		c.Failures = 0
+		c.NextTry = nil
+	}
+
+	if dberr := db.Save(&c).Error; dberr != nil {
+		log.Println("Unable to save certificate in DB:", dberr)
+		if err == nil {
+			err = dberr
+		}
+	}
+
+	return
+}
+
+func obtainCertificate(h *Host, c *Certificate) (err error) {
+	client, err := newAcmeClient()
+	if err != nil {
+		return
+	}
+
+	conf := config.Conf.Certificates
+	err = client.Challenge.SetDNS01Provider(&hostProvider{h: h},
+		dns01.CondOption(len(conf.Resolvers) > 0, dns01.AddRecursiveNameservers(dns01.ParseNameservers(conf.Resolvers))),
+		dns01.CondOption(conf.SkipPropagationCheck, dns01.WrapPreCheck(func(domain, fqdn, value string, check dns01.PreCheckFunc) (bool, error) {
+			return true, nil
+		})))
+	if err != nil {
+		return
+	}
+
+	res, err := client.Certificate.Obtain(certificate.ObtainRequest{
+		Domains: h.Zones(),
+		Bundle:  true,
+	})
+	if err != nil {
+		return
+	}
+
+	x509Cert, err := certcrypto.ParsePEMCertificate(res.Certificate)
+	if err != nil {
+		return
+	}
+
+	cert, err := utils.Encrypt(conf.EncryptionKey, res.Certificate)
+	if err != nil {
+		return
+	}
+	key, err := utils.Encrypt(conf.EncryptionKey, res.PrivateKey)
+	if err != nil {
+		return
+	}
+
+	c.Cert = cert
+	c.Key = key
+	c.NotAfter = &x509Cert.NotAfter
+
+	return
+}
+
+// RequestCertificate starts the issuance of a certificate for the host of
+// token. The result is fetched later with GetCertificate.
+func RequestCertificate(token string) (err error) {
+	h, err := GetHostByToken(token, ScopeAcme)
+	if err != nil {
+		return
+	}
+
+	return RequestHostCertificate(h)
+}
+
+// RequestHostCertificate is RequestCertificate for the host h found by
+// VerifyRequest
+func RequestHostCertificate(h *Host) (err error) {
+	if err = certificatesEnabled(); err != nil {
+		return
+	}
+
+	var c Certificate
+	if !db.Where("host_id = ?", h.ID).First(&c).RecordNotFound() {
+		if err = needsIssuance(&c, h); err != nil {
+			return
+		}
+	}
+
+	log.Println("Certificate requested for", h.Hostname)
+
+	go issueCertificate(h)
+
+	return
+}
+
+// IssueCertificate issues a certificate for the host hostname and waits for
+// the result. Unlike RequestCertificate, the current certificate and the
+// backoff after a failure are not checked.
+func IssueCertificate(hostname string) (err error) {
+	if err = certificatesEnabled(); err != nil {
+		return
+	}
+
+	h, err := GetHostByName(hostname)
+	if err != nil {
+		return
+	}
+
+	return issueCertificate(h)
+}
+
+// GetCertificate returns the decrypted certificate of the host of token
+func GetCertificate(token string) (bundle *CertificateBundle, err error) {
+	h, err := GetHostByToken(token, ScopeAcme)
+	if err != nil {
+		return
+	}
+
+	return GetHostCertificate(h)
+}
+
+// GetHostCertificate returns the decrypted certificate of the host h found
+// by VerifyRequest
+func GetHostCertificate(h *Host) (bundle *CertificateBundle, err error) {
+	var c Certificate
+	if db.Where("host_id = ?", h.ID).First(&c).RecordNotFound() {
+		return nil, fmt.Errorf("No certificate")
+	}
+
+	bundle = &CertificateBundle{
+		Status:   c.Status,
+		Domains:  strings.Split(c.Domains, ","),
+		NotAfter: c.NotAfter,
+		Error:    c.Error,
+	}
+
+	if len(c.Cert) == 0 {
+		return
+	}
+
+	secret := config.Conf.Certificates.EncryptionKey
+	cert, err := utils.Decrypt(secret, c.Cert)
+	if err != nil {
+		log.Println("Unable to decrypt certificate of", h.Hostname, ":", err)
+		return nil, fmt.Errorf("Internal error")
+	}
+	key, err := utils.Decrypt(secret, c.Key)
+	if err != nil {
+		log.Println("Unable to decrypt private key of", h.Hostname, ":", err)
+		return nil, fmt.Errorf("Internal error")
+	}
+
+	bundle.Certificate = string(cert)
+	bundle.PrivateKey = string(key)
+
+	return
+}
+
+// GetAllCertificates returns the certificates of all hosts by hostname
+func GetAllCertificates() (certs map[string]Certificate, err error) {
+	hosts, err := GetAllHosts()
+	if err != nil {
+		return
+	}
+
+	var all []Certificate
+	if err = orm.FindAll(db, &all); err != nil {
+		return
+	}
+
+	byHost := make(map[int64]Certificate)
+	for _, c := range all {
+		byHost[c.HostID] = c
+	}
+
+	certs = make(map[string]Certificate)
+	for _, h := range hosts {
+		if c, ok := byHost[h.ID]; ok {
+			certs[h.Hostname] = c
+		}
+	}
+
+	return
+}
+
+// renewCertificates is run by the cron to renew the certificates that expire
+// soon or whose host has changed its subzones. Failed issuances are retried
+// with an exponential backoff. A certificate left pending by a previous run
+// of the server is renewed like the others, the issuing map prevents two
+// issuances at the same time.
+func renewCertificates() {
+	if certificatesEnabled() != nil {
+		return
+	}
+
+	var certs []Certificate
+	if err := orm.FindAll(db, &certs); err != nil {
+		log.Println("Unable to query certificates from DB:", err)
+		return
+	}
+
+	for i := range certs {
+		var h Host
+		if err := db.First(&h, certs[i].HostID).Error; err != nil {
+			continue
+		}
+
+		if needsIssuance(&certs[i], &h) != nil {
+			continue
+		}
+
+		log.Println("Renewing certificate of", h.Hostname)
+		issueCertificate(&h)
+	}
+}
@@ -0,0 +1,281 @@
+package models
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/calaos/calaos_dns/config"
+
+	"github.com/go-acme/lego/certcrypto"
+	"github.com/miekg/dns"
+)
+
+func TestFailureBackoff(t *testing.T) {
+	for failures, want := range map[int]time.Duration{
+		1:  12 * time.Hour,
+		2:  24 * time.Hour,
+		3:  48 * time.Hour,
+		5:  7 * 24 * time.Hour,
+		50: 7 * 24 * time.Hour,
+	} {
+		if got := failureBackoff(failures); got != want {
+			t.Errorf("failureBackoff(%v) = %v, want %v", failures, got, want)
+		}
+	}
+}
+
+// hostCertificate returns the certificate of hostname in DB
+func hostCertificate(t *testing.T, hostname string) *Certificate {
+	t.Helper()
+
+	h, err := GetHostByName(hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Certificate{}
+	if err = db.Where("host_id = ?", h.ID).First(c).Error; err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// checkNextTry checks that c is failed and retried after delay
+func checkNextTry(t *testing.T, c *Certificate, failures int, delay time.Duration) {
+	t.Helper()
+
+	if c.Status != CertFailed || c.Failures != failures {
+		t.Fatalf("certificate %v after %v failures, want %v", c.Status, c.Failures, failures)
+	}
+	if c.NextTry == nil {
+		t.Fatal("no backoff after a failure")
+	}
+	if d := time.Until(*c.NextTry); d < delay-time.Minute || d > delay {
+		t.Errorf("next try in %v, want %v", d, delay)
+	}
+}
+
+func TestCertificateFailures(t *testing.T) {
+	setupTest(t)
+	config.Conf.Certificates.EncryptionKey = "certificate-test-key"
+	config.Conf.Certificates.Directory = "http://127.0.0.1:1/directory"
+
+	token := register(t, "myhome", "", "1.2.3.4", "")
+	h, err := GetHostByName("myhome")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = issueCertificate(h); err == nil {
+		t.Fatal("certificate issued without ACME server")
+	}
+	checkNextTry(t, hostCertificate(t, "myhome"), 1, 12*time.Hour)
+
+	if err = RequestCertificate(token); err == nil {
+		t.Error("certificate requested during the backoff")
+	}
+
+	//The cron does not retry before the end of the backoff
+	renewCertificates()
+	checkNextTry(t, hostCertificate(t, "myhome"), 1, 12*time.Hour)
+
+	//A certificate left pending by a stopped server is renewed, and the
+	//backoff doubles at each failure
+	db.Model(&Certificate{}).Where("host_id = ?", h.ID).Updates(map[string]interface{}{
+		"status":   CertPending,
+		"next_try": nil,
+	})
+	renewCertificates()
+	checkNextTry(t, hostCertificate(t, "myhome"), 2, 24*time.Hour)
+
+	//A valid certificate is not issued again before its renewal
+	notAfter := time.Now().AddDate(0, 0, 60)
+	db.Model(&Certificate{}).Where("host_id = ?", h.ID).Updates(map[string]interface{}{
+		"status":    CertValid,
+		"not_after": notAfter,
+		"next_try":  nil,
+		"failures":  0,
+	})
+	if err = RequestCertificate(token); err == nil {
+		t.Error("certificate requested while the current one is valid")
+	}
+
+	//but it is when a subzone is added
+	if err, _ = RegisterDns("myhome", "www", token, "", "", "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	h, _ = GetHostByName("myhome")
+	if err = needsIssuance(hostCertificate(t, "myhome"), h); err != nil {
+		t.Error("certificate of new subzones refused:", err)
+	}
+}
+
+// servePebbleDNS answers the queries of Pebble with the records of the
+// models, like the built-in DNS server does
+func servePebbleDNS(t *testing.T, addr string) {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		t.Fatal(err)
+	}
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+
+		q := r.Question[0]
+		records, exists := LookupRecords(q.Name)
+		for _, rec := range records {
+			for _, c := range rec.Content {
+				rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(rec.Name), rec.TTL, rec.Type, c))
+				if err == nil && rr.Header().Rrtype == q.Qtype {
+					m.Answer = append(m.Answer, rr)
+				}
+			}
+		}
+		if !exists {
+			m.Rcode = dns.RcodeNameError
+		}
+
+		w.WriteMsg(m)
+	})
+
+	for _, srv := range []*dns.Server{
+		{PacketConn: pc, Handler: handler},
+		{Listener: l, Handler: handler},
+	} {
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go srv.ActivateAndServe()
+		<-started
+		t.Cleanup(func() { srv.Shutdown() })
+	}
+}
+
+// issuedNames returns the names of the certificate of the host of token
+func issuedNames(t *testing.T, token string) []string {
+	t.Helper()
+
+	bundle, err := GetCertificate(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bundle.Status != CertValid {
+		t.Fatalf("certificate %v: %v", bundle.Status, bundle.Error)
+	}
+
+	cert, err := certcrypto.ParsePEMCertificate([]byte(bundle.Certificate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = certcrypto.ParsePEMPrivateKey([]byte(bundle.PrivateKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	names := append([]string(nil), cert.DNSNames...)
+	sort.Strings(names)
+	return names
+}
+
+// TestPebbleCertificates issues and renews a certificate on Pebble. It is
+// skipped unless CALAOS_DNS_TEST_PEBBLE is set to the directory of Pebble,
+// started with -dnsserver pointing to CALAOS_DNS_TEST_PEBBLE_DNS
+// (127.0.0.1:8053 by default). LEGO_CA_CERTIFICATES must be set to the CA
+// certificate of Pebble, and PEBBLE_VA_NOSLEEP=1 speeds up the test.
+func TestPebbleCertificates(t *testing.T) {
+	directory := os.Getenv("CALAOS_DNS_TEST_PEBBLE")
+	if directory == "" {
+		t.Skip("CALAOS_DNS_TEST_PEBBLE is not set")
+	}
+	dnsAddr := os.Getenv("CALAOS_DNS_TEST_PEBBLE_DNS")
+	if dnsAddr == "" {
+		dnsAddr = "127.0.0.1:8053"
+	}
+
+	setupTest(t)
+	config.Conf.Certificates.EncryptionKey = "certificate-test-key"
+	config.Conf.Certificates.Directory = directory
+	config.Conf.Certificates.Email = "admin@calaos.fr"
+	config.Conf.Certificates.SkipPropagationCheck = true
+	config.Conf.Certificates.RenewDays = 1 //Pebble may issue certificates valid for a few days
+	servePebbleDNS(t, dnsAddr)
+
+	token := register(t, "myhome", "", "1.2.3.4", "")
+
+	if err := IssueCertificate("myhome"); err != nil {
+		t.Fatal(err)
+	}
+	if names := issuedNames(t, token); !reflect.DeepEqual(names, []string{"myhome.calaos.fr"}) {
+		t.Errorf("certificate issued for %v", names)
+	}
+	first := hostCertificate(t, "myhome")
+
+	//Nothing to renew yet
+	renewCertificates()
+	if c := hostCertificate(t, "myhome"); !reflect.DeepEqual(c.Cert, first.Cert) {
+		t.Error("valid certificate renewed")
+	}
+
+	//A new subzone is added to the certificate by the renewal
+	if err, _ := RegisterDns("myhome", "www", token, "", "", "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	renewCertificates()
+	want := []string{"myhome.calaos.fr", "www.myhome.calaos.fr"}
+	if names := issuedNames(t, token); !reflect.DeepEqual(names, want) {
+		t.Errorf("certificate renewed for %v, want %v", names, want)
+	}
+
+	//A certificate expiring soon is renewed
+	second := hostCertificate(t, "myhome")
+	db.Model(&Certificate{}).Where("id = ?", second.ID).UpdateColumn("not_after", time.Now().Add(12*time.Hour))
+	renewCertificates()
+	third := hostCertificate(t, "myhome")
+	if reflect.DeepEqual(third.Cert, second.Cert) || third.NotAfter == nil || !third.NotAfter.After(renewLimit()) {
+		t.Errorf("expiring certificate not renewed, valid until %v", third.NotAfter)
+	}
+
+	//The challenges are removed once the certificate is issued
+	var count int
+	db.Model(&AcmeChallenge{}).Count(&count)
+	if count != 0 {
+		t.Errorf("%v challenges left in DB", count)
+	}
+}
+
+func TestRenewSkipsSuspended(t *testing.T) {
+	setupTest(t)
+	config.Conf.Certificates.EncryptionKey = "certificate-test-key"
+	config.Conf.Certificates.Directory = "http://127.0.0.1:1/directory"
+
+	register(t, "myhome", "", "1.2.3.4", "")
+	h, err := GetHostByName("myhome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create(&Certificate{HostID: h.ID, Status: CertPending}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = SuspendHost("myhome"); err != nil {
+		t.Fatal(err)
+	}
+
+	//A failed issuance would have started the backoff
+	renewCertificates()
+	if c := hostCertificate(t, "myhome"); c.Status != CertPending || c.Failures != 0 {
+		t.Errorf("certificate of suspended host renewed: %v after %v failures", c.Status, c.Failures)
+	}
+}
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"context"
+
+	"github.com/calaos/calaos_dns/backend"
+	"github.com/calaos/calaos_dns/config"
+)
+
+// databaseBackend is the DNS backend of the built-in DNS server. Nothing is
+// published, the records are built from the DB when they are queried, so all
+// the processes sharing the DB see the same zone.
+type databaseBackend struct{}
+
+func (b *databaseBackend) Apply(ctx context.Context, changes []backend.Change) error {
+	return nil
+}
+
+func (b *databaseBackend) UpsertRRset(ctx context.Context, name string, rrtype backend.RRType, ttl uint32, content []string) error {
+	return nil
+}
+
+func (b *databaseBackend) DeleteRRset(ctx context.Context, name string, rrtype backend.RRType) error {
+	return nil
+}
+
+func (b *databaseBackend) ListRecords(ctx context.Context, name string) ([]backend.Record, error) {
+	records, _ := LookupRecords(name)
+	return records, nil
+}
+
+func (b *databaseBackend) GetZone(ctx context.Context) (*backend.Zone, error) {
+	serial, err := GetZoneSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := ZoneRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	return &backend.Zone{
+		Name:    backend.CanonicalName(config.Conf.Powerdns.Zone),
+		Serial:  serial,
+		Records: records,
+	}, nil
+}
+
+// Notify does nothing, the serial is increased by zoneChanged and the
+// built-in DNS server notifies the secondaries
+func (b *databaseBackend) Notify(ctx context.Context) error {
+	return nil
+}
+
+func (b *databaseBackend) Check(ctx context.Context) (warnings []string, err error) {
+	if !config.Conf.Dnsserver.Enabled {
+		warnings = append(warnings, "the records of the database backend are only served by the built-in DNS server, enable the [dnsserver] section")
+	}
+	return
+}
+
+// newBackend creates the DNS backend selected in the config file
+func newBackend() (backend.Backend, error) {
+	if config.Conf.Backend.Type == "database" {
+		return &databaseBackend{}, nil
+	}
+	return backend.New()
+}
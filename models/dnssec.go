@@ -0,0 +1,292 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/calaos/calaos_dns/backend"
+	"github.com/calaos/calaos_dns/config"
+	"github.com/calaos/calaos_dns/models/orm"
+)
+
+// Stages of a ZSK rollover (pre-publish method)
+const (
+	RolloverPublished = "published" //new ZSK is published but does not sign yet
+	RolloverActive    = "active"    //new ZSK signs, old ZSK is still published
+	RolloverDone      = "done"      //old ZSK has been removed
+)
+
+// ZskRollover tracks the ZSK rollovers of the zone. The last row gives the
+// age of the current ZSK.
+type ZskRollover struct {
+	ID        int64      `gorm:"primary_key" json:"-"`
+	OldKey    uint64     `json:"old_key"`
+	NewKey    uint64     `json:"new_key"`
+	Stage     string     `json:"stage"`
+	CreatedAt *time.Time `gorm:"type:timestamp" json:"created_at,omitempty"`
+	UpdatedAt *time.Time `gorm:"type:timestamp" json:"updated_at,omitempty"`
+}
+
+// ErrCskRollover is returned when the zone has no ZSK to roll over, its
+// only key is a CSK
+var ErrCskRollover = fmt.Errorf("Zone is signed by a CSK only, add a ZSK to roll it over")
+
+type DnssecStatus struct {
+	Enabled  bool          `json:"enabled"`
+	Keys     []backend.Key `json:"keys"`
+	Rollover *ZskRollover  `json:"rollover,omitempty"`
+}
+
+func dnssecBackend() (backend.DNSSEC, error) {
+	sec, ok := dnsBackend.(backend.DNSSEC)
+	if !ok {
+		return nil, fmt.Errorf("DNS backend does not support DNSSEC")
+	}
+	return sec, nil
+}
+
+// EnableDnssec signs the zone
+func EnableDnssec() (err error) {
+	log.Println("Enabling DNSSEC for zone", config.Conf.Powerdns.Zone)
+
+	sec, err := dnssecBackend()
+	if err != nil {
+		return
+	}
+
+	ctx := context.Background()
+	err = sec.EnableDNSSEC(ctx)
+	if err != nil {
+		log.Println("Unable to enable DNSSEC:", err)
+		return
+	}
+
+	//The age of the ZSK starts now
+	keys, err := sec.ListKeys(ctx)
+	if err != nil {
+		return
+	}
+	r := &ZskRollover{NewKey: activeZsk(keys), Stage: RolloverDone}
+	if err = orm.Create(db, r); err != nil {
+		log.Println("Failed to add entry to DB:", err)
+	}
+
+	zoneChanged()
+
+	return
+}
+
+// GetDnssecStatus returns the keys of the zone and the last ZSK rollover
+func GetDnssecStatus() (status *DnssecStatus, err error) {
+	sec, err := dnssecBackend()
+	if err != nil {
+		return
+	}
+
+	status = &DnssecStatus{}
+	status.Keys, err = sec.ListKeys(context.Background())
+	if err != nil {
+		log.Println("Unable to list DNSSEC keys:", err)
+		return nil, err
+	}
+
+	for _, k := range status.Keys {
+		if k.Active {
+			status.Enabled = true
+		}
+	}
+
+	var r ZskRollover
+	if db.Order("id desc").First(&r).Error == nil {
+		status.Rollover = &r
+	}
+
+	return
+}
+
+// GetDnssecDS returns the DS records of the active KSKs to be sent to the
+// registrar
+func GetDnssecDS() (ds []string, err error) {
+	status, err := GetDnssecStatus()
+	if err != nil {
+		return
+	}
+
+	for _, k := range status.Keys {
+		if k.Active && (k.Type == backend.KeyKSK || k.Type == backend.KeyCSK) {
+			ds = append(ds, k.DS...)
+		}
+	}
+
+	if len(ds) == 0 {
+		return nil, fmt.Errorf("DNSSEC is not enabled")
+	}
+
+	return
+}
+
+// StartZskRollover publishes a new ZSK. The rollover is then completed by
+// the cron.
+func StartZskRollover() (*ZskRollover, error) {
+	return rolloverZsk(true)
+}
+
+// rolloverZskJob moves the current rollover to its next stage, or starts a
+// new one when the ZSK is older than zsk_rollover_days
+func rolloverZskJob() {
+	if _, ok := dnsBackend.(backend.DNSSEC); !ok {
+		return
+	}
+
+	r, err := rolloverZsk(false)
+	if err == ErrCskRollover {
+		return //already logged
+	}
+	if err != nil {
+		log.Println("ZSK rollover failed:", err)
+		return
+	}
+	if r != nil && r.Stage != RolloverDone {
+		log.Println("ZSK rollover in progress, stage:", r.Stage)
+	}
+}
+
+func rolloverZsk(start bool) (r *ZskRollover, err error) {
+	sec, err := dnssecBackend()
+	if err != nil {
+		return
+	}
+
+	ctx := context.Background()
+	keys, err := sec.ListKeys(ctx)
+	if err != nil {
+		return
+	}
+
+	zsk := activeZsk(keys)
+	if zsk == 0 && !hasActiveKey(keys, backend.KeyCSK) {
+		if start {
+			return nil, fmt.Errorf("DNSSEC is not enabled")
+		}
+		return
+	}
+
+	r = &ZskRollover{}
+	if db.Order("id desc").First(r).Error != nil {
+		//DNSSEC was enabled outside of calaos_dns, the age starts now
+		r = &ZskRollover{NewKey: zsk, Stage: RolloverDone}
+		if err = orm.Create(db, r); err != nil {
+			return
+		}
+	}
+
+	delay := time.Duration(config.Conf.Dnssec.RolloverDelayHours) * time.Hour
+	if delay <= 0 {
+		delay = 24 * time.Hour
+	}
+
+	switch r.Stage {
+	case RolloverDone:
+		if !start {
+			days := config.Conf.Dnssec.ZskRolloverDays
+			if days <= 0 || time.Since(*r.UpdatedAt) < time.Duration(days)*24*time.Hour {
+				return
+			}
+		}
+
+		//A CSK is also the KSK of the zone, the DS record of the registrar
+		//points to it
+		if zsk == 0 {
+			log.Println("ZSK rollover refused: zone", config.Conf.Powerdns.Zone, "is only signed by a CSK")
+			return r, ErrCskRollover
+		}
+
+		var k *backend.Key
+		k, err = sec.AddKey(ctx, backend.KeyZSK, false)
+		if err != nil {
+			return
+		}
+
+		log.Println("ZSK rollover: published new key", k.ID, "replacing", zsk)
+		r = &ZskRollover{OldKey: zsk, NewKey: k.ID, Stage: RolloverPublished}
+		err = orm.Create(db, r)
+
+	case RolloverPublished:
+		if start {
+			return r, fmt.Errorf("A ZSK rollover is already in progress")
+		}
+		if time.Since(*r.UpdatedAt) < delay {
+			return
+		}
+
+		log.Println("ZSK rollover: signing with key", r.NewKey, "instead of", r.OldKey)
+		if err = sec.SetKeyActive(ctx, r.NewKey, true); err != nil {
+			return
+		}
+		if keyType(keys, r.OldKey) == backend.KeyZSK {
+			if err = sec.SetKeyActive(ctx, r.OldKey, false); err != nil {
+				return
+			}
+		} else {
+			log.Println("ZSK rollover: keeping key", r.OldKey, "active, it is not a ZSK")
+		}
+		r.Stage = RolloverActive
+		err = orm.Save(db, r)
+
+	case RolloverActive:
+		if start {
+			return r, fmt.Errorf("A ZSK rollover is already in progress")
+		}
+		if time.Since(*r.UpdatedAt) < delay {
+			return
+		}
+
+		if keyType(keys, r.OldKey) == backend.KeyZSK {
+			log.Println("ZSK rollover: removing key", r.OldKey)
+			if err = sec.DeleteKey(ctx, r.OldKey); err != nil {
+				return
+			}
+		} else {
+			log.Println("ZSK rollover: keeping key", r.OldKey, "which is not a ZSK")
+		}
+		r.Stage = RolloverDone
+		err = orm.Save(db, r)
+	}
+
+	if err == nil {
+		zoneChanged()
+	}
+
+	return
+}
+
+// activeZsk returns the id of the ZSK signing the zone, 0 if there is none
+func activeZsk(keys []backend.Key) uint64 {
+	for _, k := range keys {
+		if k.Active && k.Type == backend.KeyZSK {
+			return k.ID
+		}
+	}
+	return 0
+}
+
+func hasActiveKey(keys []backend.Key, keyType string) bool {
+	for _, k := range keys {
+		if k.Active && k.Type == keyType {
+			return true
+		}
+	}
+	return false
+}
+
+// keyType returns the type of the key id, an empty string if it is unknown
+func keyType(keys []backend.Key, id uint64) string {
+	for _, k := range keys {
+		if k.ID == id {
+			return k.Type
+		}
+	}
+	return ""
+}
@@ -0,0 +1,118 @@
+package models
+
+import (
+	"context"
+	"testing"
+
+	"github.com/calaos/calaos_dns/backend"
+	"github.com/calaos/calaos_dns/config"
+)
+
+// ageRollover makes the last rollover older than every delay
+func ageRollover(t *testing.T) {
+	t.Helper()
+
+	err := db.Model(&ZskRollover{}).UpdateColumn("updated_at", "2000-01-01 00:00:00").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func keyTypes(t *testing.T, mem *backend.Memory) map[uint64]string {
+	t.Helper()
+
+	keys, err := mem.ListKeys(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := make(map[uint64]string)
+	for _, k := range keys {
+		if k.Active {
+			types[k.ID] = k.Type
+		} else {
+			types[k.ID] = k.Type + " inactive"
+		}
+	}
+	return types
+}
+
+func TestZskRollover(t *testing.T) {
+	mem := setupTest(t)
+	config.Conf.Dnssec.ZskRolloverDays = 90
+
+	if err := EnableDnssec(); err != nil {
+		t.Fatal(err)
+	}
+	before := keyTypes(t, mem)
+
+	r, err := StartZskRollover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = StartZskRollover(); err == nil {
+		t.Error("second rollover started")
+	}
+
+	ageRollover(t)
+	rolloverZskJob()
+	ageRollover(t)
+	rolloverZskJob()
+
+	after := keyTypes(t, mem)
+	if _, ok := after[r.OldKey]; ok {
+		t.Errorf("old ZSK %v not removed: %v", r.OldKey, after)
+	}
+	if after[r.NewKey] != backend.KeyZSK {
+		t.Errorf("new ZSK %v not active: %v", r.NewKey, after)
+	}
+	for id, typ := range before {
+		if typ == backend.KeyKSK && after[id] != backend.KeyKSK {
+			t.Errorf("KSK %v changed by the rollover: %v", id, after)
+		}
+	}
+}
+
+// TestCskRollover checks that the only key of a zone signed by
+// pdnsutil secure-zone is never removed by a rollover
+func TestCskRollover(t *testing.T) {
+	mem := setupTest(t)
+	config.Conf.Dnssec.ZskRolloverDays = 90
+	ctx := context.Background()
+
+	csk, err := mem.AddKey(ctx, backend.KeyCSK, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint64]string{csk.ID: backend.KeyCSK}
+
+	if _, err = StartZskRollover(); err != ErrCskRollover {
+		t.Errorf("rollover of a CSK: %v", err)
+	}
+
+	rolloverZskJob()
+	ageRollover(t)
+	rolloverZskJob()
+	if got := keyTypes(t, mem); len(got) != 1 || got[csk.ID] != backend.KeyCSK {
+		t.Errorf("keys after rollover: %v, want %v", got, want)
+	}
+
+	//A rollover of the CSK started before it was refused keeps the CSK
+	zsk, err := mem.AddKey(ctx, backend.KeyZSK, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Create(&ZskRollover{OldKey: csk.ID, NewKey: zsk.ID, Stage: RolloverPublished}).Error; err != nil {
+		t.Fatal(err)
+	}
+	ageRollover(t)
+	rolloverZskJob()
+	ageRollover(t)
+	rolloverZskJob()
+
+	want[zsk.ID] = backend.KeyZSK
+	got := keyTypes(t, mem)
+	if len(got) != 2 || got[csk.ID] != backend.KeyCSK || got[zsk.ID] != backend.KeyZSK {
+		t.Errorf("keys after rollover: %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"sort"
+	"sync"
+)
+
+// nameLock serializes the changes of a name
+type nameLock struct {
+	sync.Mutex
+	refs int
+}
+
+// nameLocks locks names, a lock only exists while it is used
+type nameLocks struct {
+	mutex sync.Mutex
+	names map[string]*nameLock
+}
+
+func newNameLocks() *nameLocks {
+	return &nameLocks{names: make(map[string]*nameLock)}
+}
+
+// lock locks all names until unlock is called. The names are locked in order
+// so that two calls can't wait for each other.
+func (n *nameLocks) lock(names []string) (unlock func()) {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+
+	var locked []string
+	for i, name := range sorted {
+		if i > 0 && name == sorted[i-1] {
+			continue
+		}
+
+		n.mutex.Lock()
+		l, ok := n.names[name]
+		if !ok {
+			l = &nameLock{}
+			n.names[name] = l
+		}
+		l.refs++
+		n.mutex.Unlock()
+
+		l.Lock()
+		locked = append(locked, name)
+	}
+
+	return func() {
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+
+		for _, name := range locked {
+			l := n.names[name]
+			l.Unlock()
+			if l.refs--; l.refs == 0 {
+				delete(n.names, name)
+			}
+		}
+	}
+}
+
+var hostLocks = newNameLocks()
+
+// lockHosts locks the address records of the hosts until unlock is called
+func lockHosts(hostnames []string) (unlock func()) {
+	return hostLocks.lock(hostnames)
+}
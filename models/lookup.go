@@ -0,0 +1,136 @@
+package models
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/calaos/calaos_dns/backend"
+	"github.com/calaos/calaos_dns/config"
+	"github.com/calaos/calaos_dns/utils"
+)
+
+var (
+	zoneHooks []func()
+	notifying sync.WaitGroup
+)
+
+// OnZoneChange registers f to be called after every change of the records
+// of the zone
+func OnZoneChange(f func()) {
+	zoneHooks = append(zoneHooks, f)
+}
+
+// zoneChanged is called after every change of the zone to increase its
+// serial and notify the secondaries
+func zoneChanged() {
+	if err := bumpZoneSerial(); err != nil {
+		log.Println("Unable to increase zone serial:", err)
+	}
+
+	b := dnsBackend
+	notifying.Add(1)
+	go func() {
+		defer notifying.Done()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := b.Notify(ctx); err != nil {
+			log.Println("Unable to notify zone change:", err)
+		}
+	}()
+
+	for _, f := range zoneHooks {
+		f()
+	}
+}
+
+// WaitNotify waits for the notifications of the zone changes that are sent
+// in the background. The command line tools call it before exiting.
+func WaitNotify() {
+	notifying.Wait()
+}
+
+// LookupRecords returns the records of name built from the Host and
+// AcmeChallenge tables. exists is false if name is not part of the zone.
+func LookupRecords(name string) (records []backend.Record, exists bool) {
+	name = backend.CanonicalName(name)
+
+	suffix := "." + config.Conf.Powerdns.Zone
+	if !strings.HasSuffix(name, suffix) {
+		return
+	}
+
+	labels := strings.Split(strings.TrimSuffix(name, suffix), ".")
+	acme := labels[0] == "_acme-challenge"
+	if acme {
+		labels = labels[1:]
+	}
+
+	if len(labels) == 0 || len(labels) > 2 {
+		return
+	}
+
+	h, err := GetHostByName(labels[len(labels)-1])
+	if err != nil {
+		return
+	}
+
+	if len(labels) == 2 && !utils.StringInSlice(labels[0], strings.Split(h.Subzones, ",")) {
+		return
+	}
+
+	if acme {
+		records, err = challengeRecords(name)
+		if err != nil {
+			log.Println("Unable to read challenges of", name, ":", err)
+		}
+
+		return records, len(records) > 0
+	}
+
+	records = h.addressRecords(name)
+
+	//The TXT records of acme-dns accounts are on the host name itself
+	txt, err := challengeRecords(name)
+	if err != nil {
+		log.Println("Unable to read challenges of", name, ":", err)
+	}
+
+	return append(records, txt...), true
+}
+
+// ZoneRecords returns the records of all hosts and their _acme-challenge TXT
+// records
+func ZoneRecords() (records []backend.Record, err error) {
+	hosts, err := GetAllHosts()
+	if err != nil {
+		return
+	}
+
+	for _, h := range hosts {
+		for _, z := range h.Zones() {
+			records = append(records, h.addressRecords(z)...)
+		}
+	}
+
+	acme, err := challengeRecords("")
+	if err != nil {
+		return
+	}
+
+	return append(records, acme...), nil
+}
+
+func addressRecords(name, ip, ipv6 string) (records []backend.Record) {
+	if ip != "" {
+		records = append(records, backend.Record{Name: name, Type: backend.TypeA, TTL: recordTTL, Content: []string{ip}})
+	}
+	if ipv6 != "" {
+		records = append(records, backend.Record{Name: name, Type: backend.TypeAAAA, TTL: recordTTL, Content: []string{ipv6}})
+	}
+
+	return
+}
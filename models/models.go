@@ -8,27 +8,94 @@ import (
 	"strings"
 	"time"
 
+	"github.com/calaos/calaos_dns/backend"
 	"github.com/calaos/calaos_dns/config"
 	"github.com/calaos/calaos_dns/models/orm"
 	"github.com/calaos/calaos_dns/utils"
 
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
-	"github.com/joeig/go-powerdns/v3"
 	"github.com/robfig/cron"
 )
 
+// TTL of the records published for the hosts
+const recordTTL uint32 = 60
+
 var (
 	db          *gorm.DB
 	cronTab     *cron.Cron
 	wantLogging bool
-	pdns        *powerdns.Client
+	dnsBackend  backend.Backend
 )
 
+// Init opens the DB and the DNS backend, cleans the expired hosts and
+// challenges and starts the background jobs of the server
 func Init(logSql bool) (err error) {
-	headers := make(map[string]string)
-	headers["X-API-Key"] = config.Conf.Powerdns.ApiKey
-	pdns = powerdns.NewClient(config.Conf.Powerdns.Api, "localhost", headers, nil)
+	if err = Open(logSql); err != nil {
+		return
+	}
+
+	cronTab = cron.New()
+
+	j := CronJob{
+		Func: removeExpired,
+		Name: "removeExpired()",
+	}
+	cronTab.AddJob("@every 2h", j)
+
+	j = CronJob{
+		Func: reconcileZone,
+		Name: "reconcileZone()",
+	}
+	cronTab.AddJob("@every 1h", j)
+
+	j = CronJob{
+		Func: removeExpiredChallenges,
+		Name: "removeExpiredChallenges()",
+	}
+	cronTab.AddJob("@every 15m", j)
+
+	j = CronJob{
+		Func: renewCertificates,
+		Name: "renewCertificates()",
+	}
+	cronTab.AddJob("@every 12h", j)
+
+	j = CronJob{
+		Func: rolloverZskJob,
+		Name: "rolloverZskJob()",
+	}
+	cronTab.AddJob("@every 1h", j)
+
+	j = CronJob{
+		Func: pruneRateLimits,
+		Name: "pruneRateLimits()",
+	}
+	cronTab.AddJob("@every 5m", j)
+
+	j = CronJob{
+		Func: pruneNonces,
+		Name: "pruneNonces()",
+	}
+	cronTab.AddJob("@every 10m", j)
+
+	loadRateBuckets()
+	removeExpired()
+	removeExpiredChallenges()
+
+	//start scheduler
+	cronTab.Start()
+
+	return
+}
+
+// Open opens the DB and the DNS backend without running any cleanup nor
+// background job, for the command line tools
+func Open(logSql bool) (err error) {
+	dnsBackend, err = newBackend()
+	if err != nil {
+		return
+	}
 
 	wantLogging = logSql
 	db, err = gorm.Open(config.Conf.Database.Type, config.Conf.Database.Dsn)
@@ -49,20 +116,26 @@ func Init(logSql bool) (err error) {
 
 	migrateDb()
 
-	cronTab = cron.New()
+	checkBackend()
 
-	j := CronJob{
-		Func: removeExpired,
-		Name: "removeExpired()",
-	}
-	cronTab.AddJob("@every 2h", j)
-
-	removeExpired()
+	return
+}
 
-	//start scheduler
-	cronTab.Start()
+// checkBackend reports the zone settings that prevent changes from being
+// propagated to the secondaries
+func checkBackend() {
+	warnings, err := dnsBackend.Check(context.Background())
+	if err != nil {
+		log.Println("DNS backend self-test failed:", err)
+		return
+	}
 
-	return
+	for _, w := range warnings {
+		log.Println("DNS backend self-test warning:", w)
+	}
+	if len(warnings) == 0 {
+		log.Println("DNS backend self-test passed for zone", config.Conf.Powerdns.Zone)
+	}
 }
 
 func ListCronEntries() []*cron.Entry {
@@ -86,10 +159,55 @@ func checkDbConnection() (err error) {
 	return
 }
 
+// Migration records a data migration that must only run once
+type Migration struct {
+	Name      string     `gorm:"primary_key"`
+	CreatedAt *time.Time `gorm:"type:timestamp"`
+}
+
+// runMigration runs fn if the migration name has not been run yet
+func runMigration(name string, fn func() error) {
+	if !db.Where("name = ?", name).First(&Migration{}).RecordNotFound() {
+		return
+	}
+
+	log.Println("Running migration", name)
+
+	if err := fn(); err != nil {
+		log.Println("Migration", name, "failed:", err)
+		return
+	}
+
+	if err := db.Create(&Migration{Name: name}).Error; err != nil {
+		log.Println("Unable to save migration", name, ":", err)
+	}
+}
+
+// tables are the models stored in DB
+var tables = []interface{}{
+	&Host{},
+	&ZskRollover{},
+	&AcmeChallenge{},
+	&Certificate{},
+	&AcmeAccount{},
+	&AcmeDnsAccount{},
+	&Token{},
+	&RateBucket{},
+	&Registration{},
+	&Account{},
+	&ReservedName{},
+	&SignatureNonce{},
+	&ZoneSerial{},
+	&Migration{},
+}
+
 func migrateDb() {
 	//Migrate all tables
-	db.AutoMigrate(
-		&Host{})
+	db.AutoMigrate(tables...)
+
+	migrateTokens()
+	encryptSigningSecrets()
+	runMigration("seed_reserved_names", seedReservedNames)
 }
 
 type Host struct {
@@ -97,8 +215,19 @@ type Host struct {
 	Hostname  string     `json:"mainzone"`
 	Subzones  string     `json:"subzones"`
 	IP        string     `json:"ip"`
-	Token     string     `json:"token,omitempty"`
+	IPv6      string     `gorm:"column:ipv6" json:"ipv6"`
 	UpdatedAt *time.Time `gorm:"type:timestamp" json:"updated_at,omitempty"`
+
+	//Records of a suspended host are not published and it can't be updated
+	SuspendedAt *time.Time `json:"suspended_at,omitempty"`
+
+	//Encrypted secret of the signed requests, only signed requests are
+	//accepted if SignedOnly is set
+	SigningSecret string `json:"-"`
+	SignedOnly    bool   `json:"signed_only"`
+
+	//Account owning the host, 0 for a host only known by its tokens
+	AccountID int64 `gorm:"index" json:"-"`
 }
 
 func removeExpired() {
@@ -111,10 +240,21 @@ func removeExpired() {
 		return
 	}
 
+	//acme-dns clients only update their challenges, they never expire
+	acmeDns, err := acmeDnsHosts()
+	if err != nil {
+		log.Println("Unable to query acme-dns accounts from DB:", err)
+		return
+	}
+
 	tCheck := time.Now()
 	tCheck = tCheck.AddDate(0, 0, 0-config.Conf.General.ExpirationDays)
 
 	for _, h := range hosts {
+		//a suspended host is kept so that its name can't be registered again
+		if acmeDns[h.ID] || h.Suspended() {
+			continue
+		}
 		if h.UpdatedAt.Before(tCheck) {
 			log.Println("Entry:", h.Hostname, "has expired.")
 			deleteHost(&h)
@@ -130,8 +270,78 @@ func GetAllHosts() (hosts []Host, err error) {
 	return
 }
 
-func RegisterDns(mainzone, subzone, token, ip string) (err error, newToken string) {
-	log.Println("Register new DNS:", mainzone, subzone, token, ip)
+// ErrUnknownHost is returned when no host is registered with a name
+var ErrUnknownHost = fmt.Errorf("Unknown host")
+
+// GetHostByName returns the host registered for the mainzone hostname
+func GetHostByName(hostname string) (h *Host, err error) {
+	h = &Host{}
+	params := map[string]interface{}{
+		"Hostname": hostname,
+	}
+	err = orm.FindOneByQuery(db, h, params)
+	if err != nil {
+		return nil, ErrUnknownHost
+	}
+
+	return
+}
+
+// Zones returns the full names of the mainzone and the subzones of the host
+func (h *Host) Zones() []string {
+	return hostZones(h.Hostname, h.Subzones)
+}
+
+// challengeNames returns the names of the possible TXT records of the
+// host: its _acme-challenge.*** records, and the acme-dns records on its
+// names
+func (h *Host) challengeNames() (names []string) {
+	for _, z := range h.Zones() {
+		names = append(names, "_acme-challenge."+z, z)
+	}
+	return
+}
+
+// Suspended returns true if the host has been suspended by an admin
+func (h *Host) Suspended() bool {
+	return h.SuspendedAt != nil
+}
+
+// publishedAddresses returns the addresses published for the host, the
+// parking addresses if it is suspended
+func (h *Host) publishedAddresses() (ip, ipv6 string) {
+	if h.Suspended() {
+		return parkingAddresses()
+	}
+	return h.IP, h.IPv6
+}
+
+// parkingAddresses returns the addresses of the config file published for
+// the suspended hosts, invalid addresses are ignored
+func parkingAddresses() (ip, ipv6 string) {
+	if p, valid := utils.IsValidIPv4(config.Conf.General.ParkingIP); valid {
+		ip = p
+	}
+	if p, valid := utils.IsValidIPv6(config.Conf.General.ParkingIPv6); valid {
+		ipv6 = p
+	}
+	return
+}
+
+// addressRecords returns the A and AAAA records published for name
+func (h *Host) addressRecords(name string) []backend.Record {
+	ip, ipv6 := h.publishedAddresses()
+	return addressRecords(name, ip, ipv6)
+}
+
+func RegisterDns(mainzone, subzone, token, ip, ipv6, source string) (err error, newToken string) {
+	return registerDns(mainzone, subzone, token, ip, ipv6, source, 0)
+}
+
+// registerDns is RegisterDns, a new host is owned by the account accountID
+// if it is not 0
+func registerDns(mainzone, subzone, token, ip, ipv6, source string, accountID int64) (err error, newToken string) {
+	log.Println("Register new DNS:", mainzone, subzone, utils.RedactToken(token), ip, ipv6)
 	if mainzone == "" {
 		log.Println("Failure: Mainzone is empty")
 		return fmt.Errorf("Mainzone is empty"), newToken
@@ -143,13 +353,9 @@ func RegisterDns(mainzone, subzone, token, ip string) (err error, newToken strin
 		return fmt.Errorf("Invalid hostname"), newToken
 	}
 
-	if utils.StringInSlice(mainzone, config.Conf.Powerdns.Blacklist) {
-		log.Println("Failure: Invalid hostname, is in blacklist:", mainzone)
-		return fmt.Errorf("Invalid hostname"), newToken
-	}
-
+	var subs []string
 	if subzone != "" {
-		subs := strings.Split(subzone, ",")
+		subs = strings.Split(subzone, ",")
 		for _, s := range subs {
 			_, valid = utils.IsValidSubHostname(s)
 			if !valid {
@@ -159,18 +365,30 @@ func RegisterDns(mainzone, subzone, token, ip string) (err error, newToken strin
 		}
 	}
 
+	ip, ipv6, err = checkAddresses(ip, ipv6)
+	if err != nil {
+		return err, newToken
+	}
+
 	var h Host
 	params := map[string]interface{}{
 		"Hostname": mainzone,
 	}
 	dberr := orm.FindOneByQuery(db, &h, params)
 
-	z := mainzone + "." + config.Conf.Powerdns.Zone
+	//Names reserved after the registration of a host stay usable by it
+	existing := &h
+	if dberr != nil {
+		existing = nil
+	}
+	if err = checkReservedNames(mainzone, subs, existing); err != nil {
+		return err, newToken
+	}
 
 	ctx := context.Background()
-	_, err = pdns.Zones.Get(ctx, config.Conf.Powerdns.Zone)
+	_, err = dnsBackend.GetZone(ctx)
 	if err != nil {
-		log.Println("Unable to get zone", config.Conf.Powerdns.Zone, "from PowerDNS:", err)
+		log.Println("Unable to get zone", config.Conf.Powerdns.Zone, "from DNS backend:", err)
 		return fmt.Errorf("Internal error"), newToken
 	}
 
@@ -180,362 +398,497 @@ func RegisterDns(mainzone, subzone, token, ip string) (err error, newToken strin
 			return fmt.Errorf("Host already registered"), newToken
 		}
 
+		if ip == "" && ipv6 == "" {
+			log.Println("Failure: no IP address for", mainzone)
+			return fmt.Errorf("Invalid IP address"), newToken
+		}
+
+		if err = checkHostsPerIP(db, source); err != nil {
+			if err != ErrTooManyHosts {
+				log.Println("Unable to count the hosts of", source, ":", err)
+				err = fmt.Errorf("Internal error")
+			}
+			return err, newToken
+		}
+
 		h.Hostname = mainzone
 		h.Subzones = subzone
 		h.IP = ip
-		h.Token = utils.TokenGenerator()
-
-		log.Println("Adding new host to DB with token:", h.Token)
+		h.IPv6 = ipv6
+		h.AccountID = accountID
 
-		err = orm.Create(db, &h)
-		if err != nil {
-			log.Println("Failed to add entry to DB:", err)
-			return fmt.Errorf("Internal error"), newToken
+		var changes []backend.Change
+		for _, z := range h.Zones() {
+			changes = append(changes, addressChanges(z, h.IP, h.IPv6)...)
 		}
 
-		log.Println("Adding record to PowerDNS:", z)
+		log.Println("Adding new host to DB")
 
-		err = pdns.Records.Add(ctx, config.Conf.Powerdns.Zone, z, powerdns.RRTypeA, 60, []string{ip})
-		if err != nil {
-			log.Println("Unable to add mainzone", z, ":", err)
-
-			//Something went wrong, delete everything for this host
-			deleteHost(&h)
+		log.Println("Adding records to DNS backend:", h.Zones())
 
-			return fmt.Errorf("Internal error"), newToken
-		}
-
-		if subzone != "" {
-			subs := strings.Split(subzone, ",")
-			for _, s := range subs {
-				sz := s + "." + z
-				log.Println("Adding record to PowerDNS:", sz)
-				err = pdns.Records.Add(ctx, config.Conf.Powerdns.Zone, sz, powerdns.RRTypeA, 60, []string{ip})
-				if err != nil {
-					log.Println("Unable to add subzone", sz, ":", err)
+		//The host is only committed to DB if the records are published
+		err = commitChanges(ctx, changes, func(tx *gorm.DB) error {
+			err := tx.Create(&h).Error
+			if err != nil {
+				log.Println("Failed to add entry to DB:", err)
+				return err
+			}
 
-					//Something went wrong, delete everything for this host
-					deleteHost(&h)
+			if err = addRegistration(tx, source, h.Hostname); err != nil {
+				log.Println("Failed to add registration to DB:", err)
+				return err
+			}
 
-					return fmt.Errorf("Internal error"), newToken
-				}
+			newToken, _, err = createToken(tx, h.ID, "default", ScopeFull)
+			if err != nil {
+				log.Println("Failed to add token to DB:", err)
 			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Internal error"), newToken
 		}
 	} else { //User has passed his token, do an update
 
 		//Check if his token is the right one
-		if h.Token != token {
+		t, err := findToken(token, ScopeFull)
+		if err != nil || dberr != nil || t.HostID != h.ID {
 			return fmt.Errorf("Wrong token"), newToken
 		}
 
-		if h.Subzones != subzone {
-			if h.Subzones != "" {
-				subs := strings.Split(h.Subzones, ",")
-				for _, s := range subs {
-					sz := s + "." + z
-					log.Println("Deleting record from PowerDNS:", sz)
-					err = pdns.Records.Delete(ctx, config.Conf.Powerdns.Zone, sz, powerdns.RRTypeA)
-					if err != nil {
-						log.Println("Unable to delete subzone", sz, ":", err)
-					}
-				}
-			}
-
-			if subzone != "" {
-				subs := strings.Split(subzone, ",")
-				for _, s := range subs {
-					sz := s + "." + z
-					log.Println("Adding record to PowerDNS:", sz)
-					err = pdns.Records.Add(ctx, config.Conf.Powerdns.Zone, sz, powerdns.RRTypeA, 60, []string{ip})
-					if err != nil {
-						log.Println("Unable to add subzone", sz, ":", err)
-
-						//Something went wrong, delete everything for this host
-						deleteHost(&h)
-
-						return fmt.Errorf("Internal error"), newToken
-					}
-				}
-			}
+		if h.Suspended() {
+			log.Println("Host", h.Hostname, "is suspended")
+			return ErrHostSuspended, newToken
+		}
 
-			h.Subzones = subzone
+		//Keep the address of a family that was not given
+		if ip == "" {
+			ip = h.IP
+		}
+		if ipv6 == "" {
+			ipv6 = h.IPv6
 		}
 
-		if h.IP != ip {
-			log.Println("Updating record from PowerDNS:", z)
-			err = pdns.Records.Change(ctx, config.Conf.Powerdns.Zone, z, powerdns.RRTypeA, 60, []string{ip})
-			if err != nil {
-				log.Println("Unable to update mainzone", z, ":", err)
+		var changes []backend.Change
+		newZones := hostZones(h.Hostname, subzone)
+
+		//Remove subzones that are not used anymore
+		for _, sz := range h.Zones()[1:] {
+			if !utils.StringInSlice(sz, newZones) {
+				changes = append(changes, removeAddressChanges(sz)...)
 			}
+		}
 
-			h.IP = ip
+		if h.Subzones != subzone || h.IP != ip || h.IPv6 != ipv6 {
+			for _, z := range newZones {
+				changes = append(changes, addressChanges(z, ip, ipv6)...)
+			}
 		}
 
-		err = orm.Save(db, &h)
+		h.Subzones = subzone
+		h.IP = ip
+		h.IPv6 = ipv6
+
+		log.Println("Updating records in DNS backend:", newZones)
+
+		err = commitChanges(ctx, changes, func(tx *gorm.DB) error {
+			err := tx.Save(&h).Error
+			if err != nil {
+				log.Println("Faild to save to db:", err)
+			}
+			return err
+		})
 		if err != nil {
-			log.Println("Faild to save to db:", err)
+			return fmt.Errorf("Internal error"), newToken
 		}
 	}
 
-	return nil, h.Token
+	if newToken == "" { //existing host, its token has not changed
+		newToken = token
+	}
+
+	return nil, newToken
 }
 
 func DeleteDns(token string) (err error) {
-	log.Println("Deleting host for token:", token)
+	log.Println("Deleting host for token:", utils.RedactToken(token))
 
-	var h Host
-	params := map[string]interface{}{
-		"Token": token,
-	}
-	err = orm.FindOneByQuery(db, &h, params)
+	h, err := GetHostByToken(token, ScopeFull)
 	if err != nil {
-		log.Println("Token has not been found:", err)
-		return fmt.Errorf("Unknown token")
+		return
 	}
 
-	return deleteHost(&h)
+	return deleteHost(h)
+}
+
+// DeleteHostDns deletes the host h found by VerifyRequest
+func DeleteHostDns(h *Host) (err error) {
+	log.Println("Deleting host", h.Hostname)
+
+	return deleteHost(h)
 }
 
 func deleteHost(h *Host) (err error) {
+	zones := h.Zones()
+	txt := h.challengeNames()
+
+	unlock := lockChallenges(txt)
+	defer unlock()
 
 	ctx := context.Background()
-	zone, err := pdns.Zones.Get(ctx, config.Conf.Powerdns.Zone)
+	zone, err := dnsBackend.GetZone(ctx)
 	if err != nil {
-		log.Println("Unable to get zone", config.Conf.Powerdns.Zone, "from PowerDNS:", err)
+		log.Println("Unable to get zone", config.Conf.Powerdns.Zone, "from DNS backend:", err)
 		return
 	}
 
-	z := h.Hostname + "." + config.Conf.Powerdns.Zone
+	var changes []backend.Change
 
-	//list of possible _acme-challenge.*** records
-	acme := []string{
-		"_acme-challenge." + z,
-	}
-
-	if h.Subzones != "" {
-		subs := strings.Split(h.Subzones, ",")
-		for _, s := range subs {
-			acme = append(acme, "_acme-challenge."+s+"."+z)
+	//Delete all TXT records of the host if any. They are used for letsencrypt
+	for _, rr := range zone.Records {
+		if rr.Type == backend.TypeTXT && utils.StringInSlice(rr.Name, txt) {
+			changes = append(changes, backend.Delete(rr.Name, backend.TypeTXT))
 		}
 	}
 
-	//Delete all _acme-challenge.*** if any. They are used for letsencrypt
-	for _, rr := range zone.RRsets {
-		if utils.StringInSlice(strings.Trim(*rr.Name, "."), acme) {
-			log.Println("Deleting record from PowerDNS:", rr.Name)
-			err = pdns.Records.Delete(ctx, config.Conf.Powerdns.Zone, *rr.Name, powerdns.RRTypeTXT)
-			if err != nil {
-				log.Println("Unable to delete record", rr.Name, ":", err)
-			}
-		}
+	for _, z := range zones {
+		changes = append(changes, removeAddressChanges(z)...)
 	}
 
-	if h.Subzones != "" {
-		subs := strings.Split(h.Subzones, ",")
-		for _, s := range subs {
-			sz := s + "." + z
-			log.Println("Deleting record from PowerDNS:", sz)
-			err = pdns.Records.Delete(ctx, config.Conf.Powerdns.Zone, sz, powerdns.RRTypeA)
-			if err != nil {
-				log.Println("Unable to delete subzone", sz, ":", err)
-			}
+	log.Println("Deleting records from DNS backend:", zones)
+
+	err = commitChanges(ctx, changes, func(tx *gorm.DB) error {
+		err := tx.Where("host_id = ?", h.ID).Delete(AcmeChallenge{}).Error
+		if err == nil {
+			err = tx.Where("host_id = ?", h.ID).Delete(Certificate{}).Error
 		}
-	}
+		if err == nil {
+			err = tx.Where("host_id = ?", h.ID).Delete(AcmeDnsAccount{}).Error
+		}
+		if err == nil {
+			err = tx.Where("host_id = ?", h.ID).Delete(Token{}).Error
+		}
+		if err == nil {
+			err = tx.Delete(h).Error
+		}
+		if err != nil {
+			log.Println("Unable to delete zone in DB:", err)
+		}
+		return err
+	})
 
-	log.Println("Deleting record from PowerDNS:", z)
-	err = pdns.Records.Delete(ctx, config.Conf.Powerdns.Zone, z, powerdns.RRTypeA)
-	if err != nil {
-		log.Println("Unable to delete mainzone", z, ":", err)
-	}
+	return err
+}
+
+func UpdateDns(token, ip, ipv6 string) (err error) {
+	log.Println("Updating IP for token:", utils.RedactToken(token), ip, ipv6)
 
-	err = orm.Delete(db, &h)
+	h, err := GetHostByToken(token, ScopeUpdate)
 	if err != nil {
-		log.Println("Unable to delete zone in DB:", err)
+		return
 	}
 
-	return err
+	return updateAddresses(h, ip, ipv6)
 }
 
-func UpdateDns(token, ip string) (err error) {
-	log.Println("Updating IP for token:", token, ip)
+// UpdateHostDns changes the addresses of the host h found by VerifyRequest
+func UpdateHostDns(h *Host, ip, ipv6 string) (err error) {
+	log.Println("Updating IP of host", h.Hostname, ip, ipv6)
 
-	var h Host
-	params := map[string]interface{}{
-		"Token": token,
-	}
-	err = orm.FindOneByQuery(db, &h, params)
-	if err != nil {
-		log.Println("Token has not been found:", err)
-		return fmt.Errorf("Unknown token")
-	}
+	return updateAddresses(h, ip, ipv6)
+}
 
-	ctx := context.Background()
-	_, err = pdns.Zones.Get(ctx, config.Conf.Powerdns.Zone)
+// updateAddresses changes the addresses of the host. An empty address keeps
+// the current address of its family. The records of a suspended host are
+// only updated in DB.
+func updateAddresses(h *Host, ip, ipv6 string) (err error) {
+	ip, ipv6, err = checkAddresses(ip, ipv6)
 	if err != nil {
-		log.Println("Unable to get zone", config.Conf.Powerdns.Zone, "from PowerDNS:", err)
+		return
 	}
 
-	z := h.Hostname + "." + config.Conf.Powerdns.Zone
+	//Keep the address of a family that was not given
+	if ip == "" {
+		ip = h.IP
+	}
+	if ipv6 == "" {
+		ipv6 = h.IPv6
+	}
 
-	if h.IP != ip {
-		log.Println("Updating record from PowerDNS:", z)
-		err = pdns.Records.Change(ctx, config.Conf.Powerdns.Zone, z, powerdns.RRTypeA, 60, []string{ip})
-		if err != nil {
-			log.Println("Unable to update mainzone", z, ":", err)
-		}
-
-		if h.Subzones != "" {
-			subs := strings.Split(h.Subzones, ",")
-			for _, s := range subs {
-				sz := s + "." + z
-				log.Println("Updating record from PowerDNS:", sz)
-				err = pdns.Records.Change(ctx, config.Conf.Powerdns.Zone, sz, powerdns.RRTypeA, 60, []string{ip})
-				if err != nil {
-					log.Println("Unable to update subzone", sz, ":", err)
-				}
+	var changes []backend.Change
+	if h.IP != ip || h.IPv6 != ipv6 {
+		if !h.Suspended() {
+			for _, z := range h.Zones() {
+				changes = append(changes, addressChanges(z, ip, ipv6)...)
 			}
 		}
 
 		h.IP = ip
+		h.IPv6 = ipv6
 	}
 
-	err = orm.Save(db, &h)
+	log.Println("Updating records in DNS backend:", h.Zones())
+
+	//Always save to refresh the expiration date of the host
+	err = commitChanges(context.Background(), changes, func(tx *gorm.DB) error {
+		err := tx.Save(h).Error
+		if err != nil {
+			log.Println("Faild to save to db:", err)
+		}
+		return err
+	})
 	if err != nil {
-		log.Println("Faild to save to db:", err)
+		return fmt.Errorf("Internal error")
 	}
 
 	return nil
 }
 
-func AddLeRecord(token, leDomain, leToken string) (err error) {
-	log.Println("Add Letsencrypt token for user", token, ". Domain:", leDomain, "Token:", leToken)
+// ClearDns removes all addresses of the host registered with token
+func ClearDns(token string) (err error) {
+	log.Println("Clearing IP for token:", utils.RedactToken(token))
 
-	var h Host
-	params := map[string]interface{}{
-		"Token": token,
-	}
-	err = orm.FindOneByQuery(db, &h, params)
+	h, err := GetHostByToken(token, ScopeUpdate)
 	if err != nil {
-		log.Println("Token has not been found:", err)
-		return fmt.Errorf("Unknown token")
+		return
 	}
 
-	if leDomain == "" || leToken == "" {
-		log.Println("Emtpy domain/token:", leDomain, ",", leToken)
-		return fmt.Errorf("Bad input")
+	return clearAddresses(h)
+}
+
+// ClearHostDns removes all addresses of the host h found by VerifyRequest
+func ClearHostDns(h *Host) (err error) {
+	log.Println("Clearing IP of host", h.Hostname)
+
+	return clearAddresses(h)
+}
+
+func clearAddresses(h *Host) (err error) {
+	var changes []backend.Change
+	for _, z := range h.Zones() {
+		changes = append(changes, removeAddressChanges(z)...)
 	}
 
-	ctx := context.Background()
-	_, err = pdns.Zones.Get(ctx, config.Conf.Powerdns.Zone)
+	h.IP = ""
+	h.IPv6 = ""
+
+	log.Println("Deleting records from DNS backend:", h.Zones())
+
+	err = commitChanges(context.Background(), changes, func(tx *gorm.DB) error {
+		err := tx.Save(h).Error
+		if err != nil {
+			log.Println("Faild to save to db:", err)
+		}
+		return err
+	})
 	if err != nil {
-		log.Println("Unable to get zone", config.Conf.Powerdns.Zone, "from PowerDNS:", err)
+		return fmt.Errorf("Internal error")
 	}
 
-	//Check if domain is registered for this host
-	subs := strings.Split(h.Subzones, ",")
-	if leDomain != h.Hostname && !utils.StringInSlice(leDomain, subs) {
-		log.Println("Wrong domain, not registered for user")
-		return fmt.Errorf("Wrong domain")
+	return nil
+}
+
+// checkAddresses validates the optional IPv4 and IPv6 addresses and returns
+// their canonical form
+func checkAddresses(ip, ipv6 string) (string, string, error) {
+	var valid bool
+	if ip != "" {
+		ip, valid = utils.IsValidIPv4(ip)
+		if !valid {
+			log.Println("Failure: Invalid IPv4 address:", ip)
+			return "", "", fmt.Errorf("Invalid IP address")
+		}
 	}
 
-	z := leDomain + "." + config.Conf.Powerdns.Zone
-	if leDomain != h.Hostname { //It's a subdomain
-		z = leDomain + "." + h.Hostname + "." + config.Conf.Powerdns.Zone
+	if ipv6 != "" {
+		ipv6, valid = utils.IsValidIPv6(ipv6)
+		if !valid {
+			log.Println("Failure: Invalid IPv6 address:", ipv6)
+			return "", "", fmt.Errorf("Invalid IP address")
+		}
 	}
-	acme := "_acme-challenge." + z
 
-	err = pdns.Records.Add(ctx, config.Conf.Powerdns.Zone, acme, powerdns.RRTypeTXT, 60, []string{"\"" + leToken + "\""})
-	if err != nil {
-		log.Println("Unable to update zone for letsencrypt", acme, ":", err)
+	return ip, ipv6, nil
+}
+
+// hostZones returns the full name of the mainzone followed by all its subzones
+func hostZones(hostname, subzones string) (zones []string) {
+	z := hostname + "." + config.Conf.Powerdns.Zone
+	zones = append(zones, z)
+
+	if subzones != "" {
+		for _, s := range strings.Split(subzones, ",") {
+			zones = append(zones, s+"."+z)
+		}
 	}
 
 	return
 }
 
-func DeleteLeRecord(token, leDomain string) (err error) {
-	log.Println("Delete Letsencrypt token for user", token, ". Domain:", leDomain)
+// addressChanges returns the changes replacing the A and AAAA records of
+// name. The record of a family with no address is removed.
+func addressChanges(name, ip, ipv6 string) (changes []backend.Change) {
+	if ip != "" {
+		changes = append(changes, backend.Upsert(name, backend.TypeA, recordTTL, []string{ip}))
+	} else {
+		changes = append(changes, backend.Delete(name, backend.TypeA))
+	}
 
-	var h Host
-	params := map[string]interface{}{
-		"Token": token,
+	if ipv6 != "" {
+		changes = append(changes, backend.Upsert(name, backend.TypeAAAA, recordTTL, []string{ipv6}))
+	} else {
+		changes = append(changes, backend.Delete(name, backend.TypeAAAA))
 	}
-	err = orm.FindOneByQuery(db, &h, params)
-	if err != nil {
-		log.Println("Token has not been found:", err)
-		return fmt.Errorf("Unknown token")
+
+	return
+}
+
+// removeAddressChanges returns the changes removing the A and AAAA records
+// of name
+func removeAddressChanges(name string) []backend.Change {
+	return []backend.Change{
+		backend.Delete(name, backend.TypeA),
+		backend.Delete(name, backend.TypeAAAA),
 	}
+}
 
-	if leDomain == "" {
-		log.Println("Emtpy domain:", leDomain)
-		return fmt.Errorf("Bad input")
+// commitChanges runs the DB operations of dbFn and publishes all changes
+// of a host operation at once. The DB transaction is rolled back if the DNS
+// backend fails to apply the changes. The hosts of the changed records are
+// locked until the changes are committed, so that the repair of the zone
+// does not publish again what they replace.
+func commitChanges(ctx context.Context, changes []backend.Change, dbFn func(tx *gorm.DB) error) (err error) {
+	var hostnames []string
+	for _, c := range changes {
+		if hostname, _, ok := managedName(backend.CanonicalName(c.Name)); ok {
+			hostnames = append(hostnames, hostname)
+		}
 	}
+	unlock := lockHosts(hostnames)
+	defer unlock()
 
-	ctx := context.Background()
-	_, err = pdns.Zones.Get(ctx, config.Conf.Powerdns.Zone)
+	err = orm.Transaction(db, func(tx *gorm.DB) error {
+		if err := dbFn(tx); err != nil {
+			return err
+		}
+
+		if len(changes) == 0 {
+			return nil
+		}
+
+		if err := dnsBackend.Apply(ctx, changes); err != nil {
+			log.Println("Unable to apply changes to DNS backend:", err)
+			return err
+		}
+
+		return nil
+	})
+
+	if err == nil && len(changes) > 0 {
+		zoneChanged()
+	}
+
+	return
+}
+
+// AddLeRecord adds leToken to the _acme-challenge TXT RRset of leDomain. The
+// values already published for that name are kept.
+func AddLeRecord(token, leDomain, leToken string) (err error) {
+	log.Println("Add Letsencrypt token for user", utils.RedactToken(token), ". Domain:", leDomain, "Token:", leToken)
+
+	h, err := GetHostByToken(token, ScopeAcme)
 	if err != nil {
-		log.Println("Unable to get zone", config.Conf.Powerdns.Zone, "from PowerDNS:", err)
+		return
 	}
 
-	//Check if domain is registered for this host
-	subs := strings.Split(h.Subzones, ",")
-	if leDomain != h.Hostname && !utils.StringInSlice(leDomain, subs) {
-		log.Println("Wrong domain, not registered for user")
-		return fmt.Errorf("Wrong domain")
+	return addLeRecord(h, leDomain, leToken)
+}
+
+// AddHostLeRecord is AddLeRecord for the host h found by VerifyRequest
+func AddHostLeRecord(h *Host, leDomain, leToken string) (err error) {
+	log.Println("Add Letsencrypt token for host", h.Hostname, ". Domain:", leDomain, "Token:", leToken)
+
+	return addLeRecord(h, leDomain, leToken)
+}
+
+func addLeRecord(h *Host, leDomain, leToken string) (err error) {
+	if leDomain == "" || leToken == "" {
+		log.Println("Emtpy domain/token:", leDomain, ",", leToken)
+		return fmt.Errorf("Bad input")
 	}
 
-	z := leDomain + "." + config.Conf.Powerdns.Zone
-	if leDomain != h.Hostname { //It's a subdomain
-		z = leDomain + "." + h.Hostname + "." + config.Conf.Powerdns.Zone
+	acme, err := acmeName(h, leDomain)
+	if err != nil {
+		return
 	}
-	acme := "_acme-challenge." + z
 
-	err = pdns.Records.Delete(ctx, config.Conf.Powerdns.Zone, acme, powerdns.RRTypeTXT)
+	err = addChallenge(h, acme, leToken)
 	if err != nil {
-		log.Println("Unable to update zone for letsencrypt", acme, ":", err)
+		return fmt.Errorf("Internal error")
 	}
 
 	return
 }
 
-func GetPdnsRecords(h *Host) (records []string) {
-	ctx := context.Background()
-	zone, err := pdns.Zones.Get(ctx, config.Conf.Powerdns.Zone)
+// DeleteLeRecord removes leToken from the _acme-challenge TXT RRset of
+// leDomain. All values of leDomain are removed if leToken is empty.
+func DeleteLeRecord(token, leDomain, leToken string) (err error) {
+	log.Println("Delete Letsencrypt token for user", utils.RedactToken(token), ". Domain:", leDomain, "Token:", leToken)
+
+	h, err := GetHostByToken(token, ScopeAcme)
 	if err != nil {
-		log.Println("Unable to get zone", config.Conf.Powerdns.Zone, "from PowerDNS:", err)
 		return
 	}
 
-	z := h.Hostname + "." + config.Conf.Powerdns.Zone
+	return deleteLeRecord(h, leDomain, leToken)
+}
 
-	//list of possible _acme-challenge.*** records
-	acme := []string{
-		"_acme-challenge." + z,
+// DeleteHostLeRecord is DeleteLeRecord for the host h found by VerifyRequest
+func DeleteHostLeRecord(h *Host, leDomain, leToken string) (err error) {
+	log.Println("Delete Letsencrypt token for host", h.Hostname, ". Domain:", leDomain, "Token:", leToken)
+
+	return deleteLeRecord(h, leDomain, leToken)
+}
+
+func deleteLeRecord(h *Host, leDomain, leToken string) (err error) {
+	if leDomain == "" {
+		log.Println("Emtpy domain:", leDomain)
+		return fmt.Errorf("Bad input")
 	}
 
-	if h.Subzones != "" {
-		subs := strings.Split(h.Subzones, ",")
-		for _, s := range subs {
-			acme = append(acme, "_acme-challenge."+s+"."+z)
-			acme = append(acme, s+"."+z)
-		}
+	acme, err := acmeName(h, leDomain)
+	if err != nil {
+		return
 	}
 
-	//Delete all _acme-challenge.*** if any. They are used for letsencrypt
-	for _, rr := range zone.RRsets {
-		if utils.StringInSlice(strings.Trim(*rr.Name, "."), acme) ||
-			strings.Trim(*rr.Name, ".") == z {
-			records = append(records, formatRecord(&rr))
-		}
+	err = removeChallenges(h, acme, leToken)
+	if err != nil {
+		return fmt.Errorf("Internal error")
 	}
 
 	return
 }
 
-func formatRecord(rr *powerdns.RRset) (s string) {
-	content := ""
-	if len(rr.Records) > 0 {
-		content = *rr.Records[0].Content
+// GetPdnsRecords returns the records published by the DNS backend for the host
+func GetPdnsRecords(h *Host) (records []string) {
+	ctx := context.Background()
+	zone, err := dnsBackend.GetZone(ctx)
+	if err != nil {
+		log.Println("Unable to get zone", config.Conf.Powerdns.Zone, "from DNS backend:", err)
+		return
+	}
+
+	//list of all names and possible _acme-challenge.*** records
+	var names []string
+	for _, z := range hostZones(h.Hostname, h.Subzones) {
+		names = append(names, z, "_acme-challenge."+z)
 	}
-	s = fmt.Sprintf("%v\t%v\t%v\t%v", *rr.Name, *rr.Type, *rr.TTL, content)
+
+	for _, rr := range zone.Records {
+		if utils.StringInSlice(rr.Name, names) {
+			records = append(records, rr.String())
+		}
+	}
+
 	return
 }
@@ -0,0 +1,312 @@
+package models
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/calaos/calaos_dns/backend"
+	"github.com/calaos/calaos_dns/config"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+const testZone = "calaos.fr"
+
+// setupTest opens an empty DB and publishes the zone in a memory backend.
+// The DB is a temporary sqlite file, or the DB given by
+// CALAOS_DNS_TEST_DB_TYPE and CALAOS_DNS_TEST_DB_DSN, whose tables are
+// dropped first.
+func setupTest(t *testing.T) *backend.Memory {
+	t.Helper()
+
+	config.Conf = config.Config{}
+	config.Conf.Powerdns.Zone = testZone
+	config.Conf.General.ExpirationDays = 10
+
+	dbType := os.Getenv("CALAOS_DNS_TEST_DB_TYPE")
+	dsn := os.Getenv("CALAOS_DNS_TEST_DB_DSN")
+	if dbType == "" {
+		dbType = "sqlite3"
+		dsn = filepath.Join(t.TempDir(), "test.db") + "?_busy_timeout=10000&_txlock=immediate"
+	}
+
+	var err error
+	db, err = gorm.Open(dbType, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	db.DropTableIfExists(tables...)
+	migrateDb()
+
+	mem := backend.NewMemory(testZone)
+	dnsBackend = mem
+
+	return mem
+}
+
+// records returns the content of the rrtype records of name in the backend
+func records(t *testing.T, mem *backend.Memory, name string, rrtype backend.RRType) []string {
+	t.Helper()
+
+	rrs, err := mem.ListRecords(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range rrs {
+		if r.Type == rrtype {
+			return r.Content
+		}
+	}
+	return nil
+}
+
+func checkRecords(t *testing.T, mem *backend.Memory, name string, rrtype backend.RRType, want ...string) {
+	t.Helper()
+
+	got := records(t, mem, name, rrtype)
+	if len(got) == 0 && len(want) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%v %v = %v, want %v", name, rrtype, got, want)
+	}
+}
+
+func register(t *testing.T, mainzone, subzone, ip, ipv6 string) string {
+	t.Helper()
+
+	err, token := RegisterDns(mainzone, subzone, "", ip, ipv6, "192.0.2.1")
+	if err != nil {
+		t.Fatalf("RegisterDns(%v): %v", mainzone, err)
+	}
+	return token
+}
+
+func TestRegisterUpdateDelete(t *testing.T) {
+	mem := setupTest(t)
+
+	token := register(t, "myhome", "www", "1.2.3.4", "")
+	checkRecords(t, mem, "myhome.calaos.fr", backend.TypeA, "1.2.3.4")
+	checkRecords(t, mem, "www.myhome.calaos.fr", backend.TypeA, "1.2.3.4")
+	checkRecords(t, mem, "myhome.calaos.fr", backend.TypeAAAA)
+
+	if err, _ := RegisterDns("myhome", "", "", "5.6.7.8", "", "192.0.2.1"); err == nil {
+		t.Error("host registered twice")
+	}
+
+	if err := UpdateDns(token, "5.6.7.8", "2001:db8::1"); err != nil {
+		t.Fatal(err)
+	}
+	checkRecords(t, mem, "myhome.calaos.fr", backend.TypeA, "5.6.7.8")
+	checkRecords(t, mem, "www.myhome.calaos.fr", backend.TypeAAAA, "2001:db8::1")
+
+	//Subzones are replaced by an update through RegisterDns
+	if err, _ := RegisterDns("myhome", "nas", token, "", "", "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	checkRecords(t, mem, "www.myhome.calaos.fr", backend.TypeA)
+	checkRecords(t, mem, "nas.myhome.calaos.fr", backend.TypeA, "5.6.7.8")
+
+	if err := UpdateDns("wrongtoken", "9.9.9.9", ""); err == nil {
+		t.Error("update with a wrong token accepted")
+	}
+
+	if err := DeleteDns(token); err != nil {
+		t.Fatal(err)
+	}
+	checkRecords(t, mem, "myhome.calaos.fr", backend.TypeA)
+	checkRecords(t, mem, "nas.myhome.calaos.fr", backend.TypeA)
+	if _, err := GetHostByName("myhome"); err != ErrUnknownHost {
+		t.Error("host still in DB after delete:", err)
+	}
+}
+
+func TestUpdateRefreshesExpiration(t *testing.T) {
+	setupTest(t)
+
+	token := register(t, "myhome", "", "1.2.3.4", "")
+	db.Model(&Host{}).Where("hostname = ?", "myhome").UpdateColumn("updated_at", "2000-01-01 00:00:00")
+
+	//Same address, only the expiration is refreshed
+	if err := UpdateDns(token, "1.2.3.4", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	removeExpired()
+	if _, err := GetHostByName("myhome"); err != nil {
+		t.Error("updated host expired:", err)
+	}
+}
+
+func TestChallenges(t *testing.T) {
+	mem := setupTest(t)
+
+	token := register(t, "myhome", "www", "1.2.3.4", "")
+	name := "_acme-challenge.myhome.calaos.fr"
+
+	if err := AddLeRecord(token, "myhome", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddLeRecord(token, "myhome", "value2"); err != nil {
+		t.Fatal(err)
+	}
+	checkRecords(t, mem, name, backend.TypeTXT, `"value1"`, `"value2"`)
+
+	if err := AddLeRecord(token, "www", "value3"); err != nil {
+		t.Fatal(err)
+	}
+	checkRecords(t, mem, "_acme-challenge.www.myhome.calaos.fr", backend.TypeTXT, `"value3"`)
+
+	if err := AddLeRecord(token, "other", "value4"); err == nil {
+		t.Error("challenge of another domain accepted")
+	}
+
+	if err := DeleteLeRecord(token, "myhome", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	checkRecords(t, mem, name, backend.TypeTXT, `"value2"`)
+
+	if err := DeleteLeRecord(token, "myhome", ""); err != nil {
+		t.Fatal(err)
+	}
+	checkRecords(t, mem, name, backend.TypeTXT)
+
+	//The challenges of a deleted host are removed with it
+	if err := DeleteDns(token); err != nil {
+		t.Fatal(err)
+	}
+	checkRecords(t, mem, "_acme-challenge.www.myhome.calaos.fr", backend.TypeTXT)
+}
+
+// slowNotify is a backend whose notifications take some time
+type slowNotify struct {
+	*backend.Memory
+	notified int32
+}
+
+func (b *slowNotify) Notify(ctx context.Context) error {
+	time.Sleep(100 * time.Millisecond)
+	atomic.AddInt32(&b.notified, 1)
+	return nil
+}
+
+func TestWaitNotify(t *testing.T) {
+	b := &slowNotify{Memory: setupTest(t)}
+	dnsBackend = b
+
+	register(t, "myhome", "", "1.2.3.4", "")
+	WaitNotify()
+
+	if atomic.LoadInt32(&b.notified) == 0 {
+		t.Error("zone change not notified before WaitNotify returned")
+	}
+}
+
+func TestDatabaseBackend(t *testing.T) {
+	setupTest(t)
+	dnsBackend = &databaseBackend{}
+	ctx := context.Background()
+
+	token := register(t, "myhome", "www", "1.2.3.4", "")
+
+	zone, err := dnsBackend.GetZone(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := zone.Serial
+
+	rrs, err := dnsBackend.ListRecords(ctx, "www.myhome.calaos.fr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 1 || !reflect.DeepEqual(rrs[0].Content, []string{"1.2.3.4"}) {
+		t.Errorf("records of www.myhome.calaos.fr: %v", rrs)
+	}
+
+	//The serial is increased by every change, even if made by another
+	//process sharing the DB
+	if err = UpdateDns(token, "5.6.7.8", ""); err != nil {
+		t.Fatal(err)
+	}
+	serial, err := GetZoneSerial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial <= first {
+		t.Errorf("serial %v not increased from %v", serial, first)
+	}
+
+	report, err := CheckZone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Issues) != 0 {
+		t.Errorf("issues in zone served from DB: %v", report.Issues)
+	}
+}
+
+func TestRepairZone(t *testing.T) {
+	mem := setupTest(t)
+	ctx := context.Background()
+
+	token := register(t, "myhome", "", "1.2.3.4", "")
+	mem.Apply(ctx, []backend.Change{
+		backend.Upsert("myhome.calaos.fr", backend.TypeA, recordTTL, []string{"9.9.9.9"}),
+		backend.Upsert("ghost.calaos.fr", backend.TypeA, recordTTL, []string{"192.0.2.9"}),
+	})
+
+	//Orphans are kept unless asked
+	if _, err := RepairZone(false, false); err != nil {
+		t.Fatal(err)
+	}
+	checkRecords(t, mem, "myhome.calaos.fr", backend.TypeA, "1.2.3.4")
+	checkRecords(t, mem, "ghost.calaos.fr", backend.TypeA, "192.0.2.9")
+
+	if _, err := RepairZone(false, true); err != nil {
+		t.Fatal(err)
+	}
+	checkRecords(t, mem, "ghost.calaos.fr", backend.TypeA)
+
+	//An issue is checked again against DB before its repair, the host may
+	//have been updated since the check
+	if err := UpdateDns(token, "5.6.7.8", ""); err != nil {
+		t.Fatal(err)
+	}
+	_, err := repairIssue(Issue{
+		Kind: IssueWrongIP,
+		Name: "myhome.calaos.fr",
+		Type: backend.TypeA,
+		Want: []string{"1.2.3.4"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRecords(t, mem, "myhome.calaos.fr", backend.TypeA, "5.6.7.8")
+}
+
+func TestDeleteAcmeDnsHost(t *testing.T) {
+	mem := setupTest(t)
+
+	reg, err := RegisterAcmeDns(nil, "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	txt := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQ"
+	if err = UpdateAcmeDns(reg.Username, reg.Password, reg.Subdomain, txt, "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	checkRecords(t, mem, reg.Fulldomain, backend.TypeTXT, `"`+txt+`"`)
+
+	if err = DeleteHost(reg.Subdomain); err != nil {
+		t.Fatal(err)
+	}
+	checkRecords(t, mem, reg.Fulldomain, backend.TypeTXT)
+}
@@ -19,6 +19,22 @@ func transaction(db *gorm.DB, fn dbFunc) (err error) {
 	return err
 }
 
+// Transaction runs fn in a db transaction which is committed only if fn
+// succeeds. It is rolled back otherwise.
+func Transaction(db *gorm.DB, fn func(tx *gorm.DB) error) (err error) {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
 func FindAll(db *gorm.DB, v interface{}) (err error) {
 	return transaction(db, func(tx *gorm.DB) error {
 		if err = tx.Find(v).Error; err != nil {
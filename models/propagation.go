@@ -0,0 +1,230 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/calaos/calaos_dns/backend"
+	"github.com/calaos/calaos_dns/config"
+	"github.com/calaos/calaos_dns/utils"
+
+	"github.com/miekg/dns"
+)
+
+// Interval between two queries while waiting for the propagation
+const propagationInterval = 2 * time.Second
+
+// Maximum number of requests of a host waiting for the propagation at once
+const maxPropagationWaits = 2
+
+// ErrTooManyWaits is returned when a host already has the maximum number of
+// requests waiting for the propagation
+var ErrTooManyWaits = fmt.Errorf("Too many requests waiting for the propagation")
+
+var (
+	waitsLock sync.Mutex
+	waits     = make(map[int64]int) //requests waiting by host ID
+)
+
+// NameserverStatus is the challenge as served by an authoritative nameserver
+type NameserverStatus struct {
+	Nameserver string   `json:"nameserver"`
+	Ok         bool     `json:"ok"`
+	Values     []string `json:"values"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// PropagationStatus tells if all authoritative nameservers serve the
+// expected challenge values
+type PropagationStatus struct {
+	Name        string             `json:"name"`
+	Expected    []string           `json:"expected"`
+	Propagated  bool               `json:"propagated"`
+	Nameservers []NameserverStatus `json:"nameservers"`
+}
+
+// CheckPropagation checks the challenge of leDomain for the host of token.
+// See checkPropagation.
+func CheckPropagation(token, leDomain, leToken string, wait time.Duration) (status *PropagationStatus, err error) {
+	h, err := GetHostByToken(token, ScopeAcme)
+	if err != nil {
+		return
+	}
+
+	return CheckPropagationOf(h, leDomain, leToken, wait)
+}
+
+// CheckPropagationOf is CheckPropagation for the host h found by
+// VerifyRequest. The requests of a host waiting at once are limited.
+func CheckPropagationOf(h *Host, leDomain, leToken string, wait time.Duration) (status *PropagationStatus, err error) {
+	if wait > 0 {
+		if !startWait(h.ID) {
+			return nil, ErrTooManyWaits
+		}
+		defer endWait(h.ID)
+	}
+
+	return checkPropagation(h, leDomain, leToken, wait)
+}
+
+// startWait counts a request of the host waiting for the propagation. It
+// returns false if the host already has too many of them.
+func startWait(hostID int64) bool {
+	waitsLock.Lock()
+	defer waitsLock.Unlock()
+
+	if waits[hostID] >= maxPropagationWaits {
+		return false
+	}
+	waits[hostID]++
+	return true
+}
+
+func endWait(hostID int64) {
+	waitsLock.Lock()
+	defer waitsLock.Unlock()
+
+	if waits[hostID]--; waits[hostID] <= 0 {
+		delete(waits, hostID)
+	}
+}
+
+// CheckHostPropagation checks the challenge of leDomain for the host
+// hostname. See checkPropagation.
+func CheckHostPropagation(hostname, leDomain, leToken string, wait time.Duration) (status *PropagationStatus, err error) {
+	h, err := GetHostByName(hostname)
+	if err != nil {
+		return
+	}
+
+	return checkPropagation(h, leDomain, leToken, wait)
+}
+
+// checkPropagation queries the authoritative nameservers for the challenge
+// of leDomain until all of them serve leToken, or all outstanding values if
+// leToken is empty. It returns after the first check if wait is 0, wait is
+// limited by the configured timeout.
+func checkPropagation(h *Host, leDomain, leToken string, wait time.Duration) (status *PropagationStatus, err error) {
+	if leDomain == "" {
+		leDomain = h.Hostname
+	}
+
+	name, err := acmeName(h, leDomain)
+	if err != nil {
+		return
+	}
+
+	expected := []string{leToken}
+	if leToken == "" {
+		expected, err = challengeValues(db, name)
+		if err != nil {
+			log.Println("Unable to read challenges from DB:", err)
+			return nil, fmt.Errorf("Internal error")
+		}
+		if len(expected) == 0 {
+			return nil, fmt.Errorf("No challenge")
+		}
+	}
+
+	servers, err := authoritativeServers()
+	if err != nil {
+		log.Println("Unable to find the nameservers of", config.Conf.Powerdns.Zone, ":", err)
+		return nil, fmt.Errorf("No nameserver")
+	}
+
+	timeout := time.Duration(config.Conf.Propagation.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 120 * time.Second
+	}
+	if wait > timeout {
+		wait = timeout
+	}
+	deadline := time.Now().Add(wait)
+
+	for {
+		status = &PropagationStatus{
+			Name:       name,
+			Expected:   expected,
+			Propagated: true,
+		}
+
+		for _, ns := range servers {
+			s := queryChallenge(ns, name, expected)
+			status.Nameservers = append(status.Nameservers, s)
+			status.Propagated = status.Propagated && s.Ok
+		}
+
+		if status.Propagated || time.Now().Add(propagationInterval).After(deadline) {
+			return
+		}
+
+		time.Sleep(propagationInterval)
+	}
+}
+
+// authoritativeServers returns the address of the configured nameservers or
+// of the NS records of the zone
+func authoritativeServers() (servers []string, err error) {
+	//Copy the config, its entries are completed below
+	servers = append([]string(nil), config.Conf.Propagation.Nameservers...)
+	if len(servers) == 0 {
+		var nss []*net.NS
+		nss, err = net.LookupNS(config.Conf.Powerdns.Zone)
+		if err != nil {
+			return
+		}
+		for _, ns := range nss {
+			servers = append(servers, backend.CanonicalName(ns.Host))
+		}
+	}
+
+	for i, s := range servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			servers[i] = net.JoinHostPort(s, "53")
+		}
+	}
+
+	return
+}
+
+// queryChallenge asks ns for the TXT records of name without recursion
+func queryChallenge(ns, name string, expected []string) (s NameserverStatus) {
+	s.Nameserver = ns
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeTXT)
+	m.RecursionDesired = false
+
+	c := &dns.Client{Timeout: 5 * time.Second}
+	r, _, err := c.Exchange(m, ns)
+	if err == nil && r.Truncated {
+		c.Net = "tcp"
+		r, _, err = c.Exchange(m, ns)
+	}
+	if err != nil {
+		s.Error = err.Error()
+		return
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		s.Error = dns.RcodeToString[r.Rcode]
+		return
+	}
+
+	for _, rr := range r.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			s.Values = append(s.Values, txt.Txt...)
+		}
+	}
+
+	s.Ok = true
+	for _, v := range expected {
+		if !utils.StringInSlice(v, s.Values) {
+			s.Ok = false
+		}
+	}
+
+	return
+}
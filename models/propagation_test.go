@@ -0,0 +1,46 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/calaos/calaos_dns/config"
+)
+
+func TestPropagationWaits(t *testing.T) {
+	setupTest(t)
+	config.Conf.Propagation.Nameservers = []string{"127.0.0.1:1"}
+
+	token := register(t, "myhome", "", "1.2.3.4", "")
+	h, err := GetHostByName("myhome")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < maxPropagationWaits; i++ {
+		if !startWait(h.ID) {
+			t.Fatalf("wait %v refused", i+1)
+		}
+	}
+
+	if _, err = CheckPropagation(token, "", "value", time.Second); err != ErrTooManyWaits {
+		t.Errorf("wait over the limit: %v", err)
+	}
+
+	//A check without waiting is not limited
+	if _, err = CheckPropagation(token, "", "value", 0); err == ErrTooManyWaits {
+		t.Error("check without wait refused")
+	}
+
+	endWait(h.ID)
+	if !startWait(h.ID) {
+		t.Error("wait refused after the end of another one")
+	}
+
+	for i := 0; i < maxPropagationWaits; i++ {
+		endWait(h.ID)
+	}
+	if len(waits) != 0 {
+		t.Errorf("waits left: %v", waits)
+	}
+}
@@ -0,0 +1,263 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/calaos/calaos_dns/config"
+	"github.com/calaos/calaos_dns/models/orm"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Kinds of rate limits
+const (
+	LimitIP    = "ip"
+	LimitToken = "token"
+)
+
+// ErrTooManyHosts is returned when a source IP has registered too many hosts
+var ErrTooManyHosts = fmt.Errorf("Too many hosts registered from this address")
+
+// RateBucket is the token bucket of a source IP or a token. Tokens are keyed
+// by a hash, they are never kept in clear text.
+type RateBucket struct {
+	Key       string    `gorm:"primary_key" json:"key"`
+	Tokens    float64   `json:"tokens"`
+	Allowed   int64     `json:"allowed"`
+	Limited   int64     `json:"limited"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Registration is a host registered from a source IP, kept to limit the
+// number of hosts an IP can register
+type Registration struct {
+	ID        int64  `gorm:"primary_key"`
+	IP        string `gorm:"index"`
+	Hostname  string
+	CreatedAt *time.Time `gorm:"type:timestamp;index"`
+}
+
+// RateStats are the counters of the rate limits shown to the admins
+type RateStats struct {
+	Allowed       int64          `json:"allowed"`
+	Limited       int64          `json:"limited"`
+	Buckets       []RateBucket   `json:"buckets"`
+	Registrations map[string]int `json:"registrations"`
+}
+
+var (
+	rateLock    sync.Mutex
+	rateBuckets = make(map[string]*RateBucket)
+	rateAllowed int64
+	rateLimited int64
+)
+
+// rateParams returns the refill rate per second and the size of the buckets
+// of kind. A zero rate disables the limit.
+func rateParams(kind string) (rate, burst float64) {
+	conf := config.Conf.Ratelimit
+	perMinute, b := conf.Rate, conf.Burst
+	if kind == LimitToken {
+		perMinute, b = conf.TokenRate, conf.TokenBurst
+	}
+
+	rate = perMinute / 60
+	burst = float64(b)
+	if burst < 1 {
+		burst = math.Max(1, perMinute)
+	}
+	return
+}
+
+func rateKey(kind, value string) string {
+	if kind == LimitToken {
+		sum := sha256.Sum256([]byte(value))
+		value = hex.EncodeToString(sum[:8])
+	}
+	return kind + ":" + value
+}
+
+// AllowRequest takes a request from the bucket of value, a source IP or a
+// token. When the bucket is empty, it returns false and the delay before
+// the next request is allowed.
+func AllowRequest(kind, value string) (ok bool, retry time.Duration) {
+	rate, burst := rateParams(kind)
+	if rate <= 0 || value == "" {
+		return true, 0
+	}
+
+	rateLock.Lock()
+	defer rateLock.Unlock()
+
+	key := rateKey(kind, value)
+	now := time.Now()
+	b, found := rateBuckets[key]
+	if !found {
+		b = &RateBucket{Key: key, Tokens: burst, UpdatedAt: now}
+		rateBuckets[key] = b
+	}
+
+	b.Tokens = math.Min(burst, b.Tokens+now.Sub(b.UpdatedAt).Seconds()*rate)
+	b.UpdatedAt = now
+
+	if b.Tokens < 1 {
+		b.Limited++
+		rateLimited++
+		retry = time.Duration((1 - b.Tokens) / rate * float64(time.Second))
+		log.Println("Rate limit reached for", kind, "key", key)
+		return false, retry
+	}
+
+	b.Tokens--
+	b.Allowed++
+	rateAllowed++
+	return true, 0
+}
+
+// checkHostsPerIP returns ErrTooManyHosts if ip has registered the maximum
+// number of hosts within the window
+func checkHostsPerIP(tx *gorm.DB, ip string) error {
+	max := config.Conf.Ratelimit.HostsPerIP
+	if max <= 0 || ip == "" {
+		return nil
+	}
+
+	var count int
+	err := tx.Model(&Registration{}).Where("ip = ? AND created_at > ?", ip, hostsWindowStart()).Count(&count).Error
+	if err != nil {
+		return err
+	}
+
+	if count >= max {
+		log.Println("Source IP", ip, "has already registered", count, "hosts")
+		return ErrTooManyHosts
+	}
+
+	return nil
+}
+
+// addRegistration records that ip has registered hostname
+func addRegistration(tx *gorm.DB, ip, hostname string) error {
+	if ip == "" {
+		return nil
+	}
+	return tx.Create(&Registration{IP: ip, Hostname: hostname}).Error
+}
+
+func hostsWindowStart() time.Time {
+	hours := config.Conf.Ratelimit.HostsWindowHours
+	if hours <= 0 {
+		hours = 24
+	}
+	return time.Now().Add(-time.Duration(hours) * time.Hour)
+}
+
+// GetRateStats returns the counters of the rate limits, the buckets that
+// have been limited first
+func GetRateStats() (stats *RateStats, err error) {
+	rateLock.Lock()
+	stats = &RateStats{
+		Allowed:       rateAllowed,
+		Limited:       rateLimited,
+		Buckets:       []RateBucket{},
+		Registrations: make(map[string]int),
+	}
+	for _, b := range rateBuckets {
+		stats.Buckets = append(stats.Buckets, *b)
+	}
+	rateLock.Unlock()
+
+	sort.Slice(stats.Buckets, func(i, j int) bool {
+		if stats.Buckets[i].Limited != stats.Buckets[j].Limited {
+			return stats.Buckets[i].Limited > stats.Buckets[j].Limited
+		}
+		return stats.Buckets[i].Allowed > stats.Buckets[j].Allowed
+	})
+
+	var regs []Registration
+	err = db.Where("created_at > ?", hostsWindowStart()).Find(&regs).Error
+	if err != nil {
+		log.Println("Unable to query registrations from DB:", err)
+		return nil, fmt.Errorf("Internal error")
+	}
+	for _, r := range regs {
+		stats.Registrations[r.IP]++
+	}
+
+	return
+}
+
+// loadRateBuckets restores the buckets saved by a previous run
+func loadRateBuckets() {
+	if !config.Conf.Ratelimit.Persist {
+		return
+	}
+
+	var buckets []RateBucket
+	if err := db.Find(&buckets).Error; err != nil {
+		log.Println("Unable to query rate limits from DB:", err)
+		return
+	}
+
+	rateLock.Lock()
+	for i := range buckets {
+		rateBuckets[buckets[i].Key] = &buckets[i]
+	}
+	rateLock.Unlock()
+}
+
+// pruneRateLimits is run by the cron to forget the buckets that are full
+// again and the registrations out of the window. The buckets left are saved
+// in DB if persist is set.
+func pruneRateLimits() {
+	now := time.Now()
+
+	rateLock.Lock()
+	for key, b := range rateBuckets {
+		kind := LimitIP
+		if strings.HasPrefix(key, LimitToken+":") {
+			kind = LimitToken
+		}
+		rate, burst := rateParams(kind)
+		if rate <= 0 || b.Tokens+now.Sub(b.UpdatedAt).Seconds()*rate >= burst {
+			delete(rateBuckets, key)
+		}
+	}
+
+	var buckets []RateBucket
+	for _, b := range rateBuckets {
+		buckets = append(buckets, *b)
+	}
+	rateLock.Unlock()
+
+	if err := db.Where("created_at <= ?", hostsWindowStart()).Delete(Registration{}).Error; err != nil {
+		log.Println("Unable to remove old registrations from DB:", err)
+	}
+
+	if !config.Conf.Ratelimit.Persist {
+		return
+	}
+
+	err := orm.Transaction(db, func(tx *gorm.DB) error {
+		if err := tx.Delete(RateBucket{}).Error; err != nil {
+			return err
+		}
+		for i := range buckets {
+			if err := tx.Create(&buckets[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Unable to save rate limits in DB:", err)
+	}
+}
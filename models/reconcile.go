@@ -0,0 +1,311 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/calaos/calaos_dns/backend"
+	"github.com/calaos/calaos_dns/config"
+	"github.com/calaos/calaos_dns/utils"
+)
+
+// Kinds of differences found between the Host table and the zone
+const (
+	IssueMissing  = "missing"   //record of a host is not in the zone
+	IssueWrongIP  = "wrong-ip"  //record has another address than the host
+	IssueWrongTxt = "wrong-txt" //challenge record has other values than DB
+	IssueStale    = "stale"     //record of a host that should not exist anymore
+	IssueOrphan   = "orphan"    //record of a host that is not in DB
+)
+
+type Issue struct {
+	Kind string
+	Name string
+	Type backend.RRType
+	Host string
+	Want []string
+	Got  []string
+}
+
+func (i Issue) String() string {
+	s := fmt.Sprintf("%-8v %v %v", i.Kind, i.Name, i.Type)
+	if len(i.Want) > 0 {
+		s += fmt.Sprintf(" want:%v", i.Want)
+	}
+	if len(i.Got) > 0 {
+		s += fmt.Sprintf(" got:%v", i.Got)
+	}
+	return s
+}
+
+type ZoneReport struct {
+	Hosts   int
+	Records int
+	Issues  []Issue
+}
+
+// CheckZone compares every host with the records of the zone. Records that
+// do not look like host records, or whose name is reserved and not used by a
+// host, are not managed and are ignored.
+func CheckZone() (report *ZoneReport, err error) {
+	//The zone is read first, a host changed in between is then reported
+	//with its new addresses and the repair checks it again
+	zone, err := dnsBackend.GetZone(context.Background())
+	if err != nil {
+		log.Println("Unable to get zone", config.Conf.Powerdns.Zone, "from DNS backend:", err)
+		return
+	}
+
+	hosts, err := GetAllHosts()
+	if err != nil {
+		return
+	}
+
+	reserved, err := ListReservedNames()
+	if err != nil {
+		return
+	}
+
+	report = &ZoneReport{
+		Hosts: len(hosts),
+	}
+
+	byHostname := make(map[string]*Host)
+	for i := range hosts {
+		byHostname[hosts[i].Hostname] = &hosts[i]
+	}
+
+	//Expected records of all hosts
+	type key struct {
+		name   string
+		rrtype backend.RRType
+	}
+	want := make(map[key]backend.Record)
+	for _, h := range hosts {
+		for _, z := range h.Zones() {
+			for _, r := range h.addressRecords(z) {
+				want[key{r.Name, r.Type}] = r
+			}
+		}
+	}
+
+	challenges, err := challengeRecords("")
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range challenges {
+		want[key{r.Name, r.Type}] = r
+	}
+
+	found := make(map[key]bool)
+	for _, r := range zone.Records {
+		hostname, acme, ok := managedName(r.Name)
+		if !ok {
+			continue
+		}
+		if !acme && r.Type == backend.TypeTXT {
+			//only the TXT records of acme-dns accounts are managed
+			if _, expected := want[key{r.Name, r.Type}]; !expected {
+				continue
+			}
+		} else if !acme && r.Type != backend.TypeA && r.Type != backend.TypeAAAA {
+			continue
+		}
+		if acme && r.Type != backend.TypeTXT {
+			continue
+		}
+
+		report.Records++
+
+		_, exists := byHostname[hostname]
+		if !exists && matchReserved(reserved, hostname) != nil {
+			continue
+		}
+		if !exists {
+			report.Issues = append(report.Issues, Issue{Kind: IssueOrphan, Name: r.Name, Type: r.Type, Got: r.Content})
+			continue
+		}
+
+		k := key{r.Name, r.Type}
+		w, expected := want[k]
+		if !expected {
+			report.Issues = append(report.Issues, Issue{Kind: IssueStale, Name: r.Name, Type: r.Type, Host: hostname, Got: r.Content})
+			continue
+		}
+
+		found[k] = true
+		if r.Type == backend.TypeTXT {
+			if !sameValues(w.Content, r.Content) {
+				report.Issues = append(report.Issues, Issue{Kind: IssueWrongTxt, Name: r.Name, Type: r.Type, Host: hostname, Want: w.Content, Got: r.Content})
+			}
+			continue
+		}
+		if !sameAddresses(w.Content, r.Content) {
+			report.Issues = append(report.Issues, Issue{Kind: IssueWrongIP, Name: r.Name, Type: r.Type, Host: hostname, Want: w.Content, Got: r.Content})
+		}
+	}
+
+	for k, w := range want {
+		if !found[k] {
+			hostname, _, _ := managedName(k.name)
+			report.Issues = append(report.Issues, Issue{Kind: IssueMissing, Name: k.name, Type: k.rrtype, Host: hostname, Want: w.Content})
+		}
+	}
+
+	sort.Slice(report.Issues, func(i, j int) bool {
+		if report.Issues[i].Name != report.Issues[j].Name {
+			return report.Issues[i].Name < report.Issues[j].Name
+		}
+		return report.Issues[i].Type < report.Issues[j].Type
+	})
+
+	return
+}
+
+// RepairZone fixes the issues found by CheckZone. Orphan records may have
+// been added by hand to the zone, they are only deleted if deleteOrphans is
+// set. Nothing is changed when dryRun is set.
+func RepairZone(dryRun, deleteOrphans bool) (report *ZoneReport, err error) {
+	report, err = CheckZone()
+	if err != nil || dryRun || len(report.Issues) == 0 {
+		return
+	}
+
+	repaired := false
+	for _, i := range report.Issues {
+		if i.Kind == IssueOrphan && !deleteOrphans {
+			continue
+		}
+
+		var changed bool
+		changed, err = repairIssue(i)
+		if changed {
+			repaired = true
+		}
+		if err != nil {
+			log.Println("Unable to apply changes to DNS backend:", err)
+			break
+		}
+	}
+
+	if repaired {
+		zoneChanged()
+	}
+
+	return
+}
+
+// repairIssue fixes an issue found by CheckZone if it is still there. The
+// records of the issue are locked and checked again against DB, a host may
+// have been changed since the check.
+func repairIssue(i Issue) (changed bool, err error) {
+	var unlock func()
+	if i.Type == backend.TypeTXT {
+		unlock = lockChallenges([]string{i.Name})
+	} else {
+		hostname, _, _ := managedName(i.Name)
+		unlock = lockHosts([]string{hostname})
+	}
+	defer unlock()
+
+	//Records of the name as built from DB now
+	var want []string
+	records, _ := LookupRecords(i.Name)
+	for _, r := range records {
+		if r.Type == i.Type {
+			want = r.Content
+		}
+	}
+
+	i.Want = want
+	c := backend.Delete(i.Name, i.Type)
+	if len(want) > 0 {
+		c = backend.Upsert(i.Name, i.Type, recordTTL, want)
+	}
+
+	log.Println("Repairing zone:", i)
+
+	err = dnsBackend.Apply(context.Background(), []backend.Change{c})
+	return err == nil, err
+}
+
+// reconcileZone is run by the cron to report and optionally fix the
+// differences between DB and the zone
+func reconcileZone() {
+	log.Println("Checking zone against DB...")
+
+	report, err := RepairZone(!config.Conf.General.ReconcileRepair, config.Conf.General.ReconcileDeleteOrphans)
+	if err != nil {
+		log.Println("Zone check failed:", err)
+		return
+	}
+
+	for _, i := range report.Issues {
+		log.Println("Zone check:", i)
+	}
+	log.Println("Zone check done:", len(report.Issues), "issues for", report.Hosts, "hosts")
+}
+
+// managedName returns the hostname a record name belongs to if it is shaped
+// like a host record: [_acme-challenge.][subzone.]hostname.zone
+func managedName(name string) (hostname string, acme bool, ok bool) {
+	suffix := "." + config.Conf.Powerdns.Zone
+	if !strings.HasSuffix(name, suffix) {
+		return
+	}
+
+	labels := strings.Split(strings.TrimSuffix(name, suffix), ".")
+	if labels[0] == "_acme-challenge" {
+		acme = true
+		labels = labels[1:]
+	}
+
+	if len(labels) == 0 || len(labels) > 2 {
+		return
+	}
+
+	hostname = labels[len(labels)-1]
+	if _, valid := utils.IsValidHostname(hostname); !valid {
+		return "", false, false
+	}
+
+	return hostname, acme, true
+}
+
+func sameAddresses(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !net.ParseIP(a[i]).Equal(net.ParseIP(b[i])) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sameValues compares two TXT RRsets regardless of the order of the values
+func sameValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	count := make(map[string]int)
+	for _, v := range a {
+		count[v]++
+	}
+	for _, v := range b {
+		if count[v] == 0 {
+			return false
+		}
+		count[v]--
+	}
+
+	return true
+}
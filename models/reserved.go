@@ -0,0 +1,191 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/calaos/calaos_dns/config"
+	"github.com/calaos/calaos_dns/models/orm"
+	"github.com/calaos/calaos_dns/utils"
+)
+
+// Kinds of the reserved name rules
+const (
+	ReservedExact  = "exact"  //the name itself
+	ReservedPrefix = "prefix" //names starting with the pattern
+	ReservedGlob   = "glob"   //shell pattern with * ? and [...]
+	ReservedRegex  = "regex"  //regular expression, not anchored
+)
+
+// ErrReservedName is returned when a host or a subzone uses a reserved name
+var ErrReservedName = fmt.Errorf("Hostname is reserved")
+
+// ReservedName is a rule preventing the registration of names
+type ReservedName struct {
+	ID        int64      `gorm:"primary_key" json:"id"`
+	Kind      string     `json:"kind"`
+	Pattern   string     `json:"pattern"`
+	Reason    string     `json:"reason"`
+	CreatedAt *time.Time `gorm:"type:timestamp" json:"created_at"`
+}
+
+// ValidReservedKind returns true if kind is one of the rule kinds
+func ValidReservedKind(kind string) bool {
+	return kind == ReservedExact || kind == ReservedPrefix || kind == ReservedGlob || kind == ReservedRegex
+}
+
+// Match returns true if the rule reserves name
+func (r *ReservedName) Match(name string) bool {
+	switch r.Kind {
+	case ReservedExact:
+		return name == r.Pattern
+	case ReservedPrefix:
+		return strings.HasPrefix(name, r.Pattern)
+	case ReservedGlob:
+		ok, _ := path.Match(r.Pattern, name)
+		return ok
+	case ReservedRegex:
+		ok, _ := regexp.MatchString(r.Pattern, name)
+		return ok
+	}
+	return false
+}
+
+// ListReservedNames returns all reserved name rules
+func ListReservedNames() (rules []ReservedName, err error) {
+	err = db.Order("id").Find(&rules).Error
+	if err != nil {
+		log.Println("Unable to query reserved names from DB:", err)
+		return nil, fmt.Errorf("Internal error")
+	}
+	return
+}
+
+// AddReservedName adds a rule reserving the names matching pattern
+func AddReservedName(kind, pattern, reason string) (r *ReservedName, err error) {
+	if !ValidReservedKind(kind) {
+		return nil, fmt.Errorf("Invalid kind, must be exact, prefix, glob or regex")
+	}
+
+	if kind != ReservedRegex {
+		pattern = strings.ToLower(pattern)
+	}
+	pattern = strings.TrimSpace(pattern)
+	if pattern == "" {
+		return nil, fmt.Errorf("Pattern is empty")
+	}
+
+	switch kind {
+	case ReservedGlob:
+		if _, err = path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid glob pattern")
+		}
+	case ReservedRegex:
+		if _, err = regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("Invalid regular expression: %v", err)
+		}
+	}
+
+	log.Println("Reserving", kind, "names", pattern, ":", reason)
+
+	r = &ReservedName{
+		Kind:    kind,
+		Pattern: pattern,
+		Reason:  reason,
+	}
+	if err = orm.Create(db, r); err != nil {
+		log.Println("Unable to add reserved name to DB:", err)
+		return nil, fmt.Errorf("Internal error")
+	}
+
+	return
+}
+
+// DeleteReservedName removes the rule id
+func DeleteReservedName(id int64) (err error) {
+	r := &ReservedName{}
+	if db.First(r, id).RecordNotFound() {
+		return fmt.Errorf("Unknown reserved name")
+	}
+
+	log.Println("Removing reserved", r.Kind, "names", r.Pattern)
+
+	if err = db.Delete(r).Error; err != nil {
+		log.Println("Unable to delete reserved name from DB:", err)
+		return fmt.Errorf("Internal error")
+	}
+
+	return
+}
+
+// CheckReservedName returns the first rule reserving name, nil if it is free
+func CheckReservedName(name string) (*ReservedName, error) {
+	rules, err := ListReservedNames()
+	if err != nil {
+		return nil, err
+	}
+	return matchReserved(rules, name), nil
+}
+
+func matchReserved(rules []ReservedName, name string) *ReservedName {
+	for i := range rules {
+		if rules[i].Match(name) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// checkReservedNames refuses a reserved mainzone for a new host and the
+// reserved subzones that the host h does not have yet. h is nil for a new
+// host.
+func checkReservedNames(mainzone string, subzones []string, h *Host) error {
+	rules, err := ListReservedNames()
+	if err != nil {
+		return err
+	}
+
+	names := subzones
+	var current []string
+	if h == nil {
+		names = append([]string{mainzone}, subzones...)
+	} else {
+		current = strings.Split(h.Subzones, ",")
+	}
+
+	for _, n := range names {
+		if n == "" || (h != nil && utils.StringInSlice(n, current)) {
+			continue
+		}
+		if r := matchReserved(rules, n); r != nil {
+			log.Println("Failure: Hostname", n, "is reserved by", r.Kind, r.Pattern, ":", r.Reason)
+			return ErrReservedName
+		}
+	}
+
+	return nil
+}
+
+// seedReservedNames copies the blacklist of the config file into the
+// reserved names table. It only runs once, the rules are then managed in DB.
+func seedReservedNames() error {
+	rules, err := ListReservedNames()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range config.Conf.Powerdns.Blacklist {
+		if name == "" || matchReserved(rules, strings.ToLower(name)) != nil {
+			continue
+		}
+		if _, err := AddReservedName(ReservedExact, name, "config blacklist"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package models
+
+import "testing"
+
+func TestReservedNameMatch(t *testing.T) {
+	for _, c := range []struct {
+		kind, pattern, name string
+		want                bool
+	}{
+		{ReservedExact, "www", "www", true},
+		{ReservedExact, "www", "www2", false},
+		{ReservedExact, "www", "mywww", false},
+		{ReservedPrefix, "admin", "admin", true},
+		{ReservedPrefix, "admin", "administrator", true},
+		{ReservedPrefix, "admin", "myadmin", false},
+		{ReservedGlob, "*calaos*", "mycalaoshome", true},
+		{ReservedGlob, "*calaos*", "calaos", true},
+		{ReservedGlob, "*calaos*", "mycalhome", false},
+		{ReservedGlob, "ns?", "ns1", true},
+		{ReservedGlob, "ns?", "ns12", false},
+		{ReservedGlob, "ns[0-9]", "nsa", false},
+		{ReservedRegex, "^mail[0-9]*$", "mail42", true},
+		{ReservedRegex, "^mail[0-9]*$", "mailbox", false},
+		{ReservedRegex, "test", "mytesthome", true}, //not anchored
+		{"unknown", "www", "www", false},
+	} {
+		r := &ReservedName{Kind: c.kind, Pattern: c.pattern}
+		if got := r.Match(c.name); got != c.want {
+			t.Errorf("%v %v matches %v: %v, want %v", c.kind, c.pattern, c.name, got, c.want)
+		}
+	}
+}
+
+func TestAddReservedName(t *testing.T) {
+	setupTest(t)
+
+	for _, c := range []struct {
+		kind, pattern string
+	}{
+		{"other", "www"},
+		{ReservedExact, " "},
+		{ReservedGlob, "ns[0-9"},
+		{ReservedRegex, "mail("},
+	} {
+		if _, err := AddReservedName(c.kind, c.pattern, ""); err == nil {
+			t.Errorf("invalid %v rule %q added", c.kind, c.pattern)
+		}
+	}
+
+	//Patterns are lower case, except regular expressions
+	r, err := AddReservedName(ReservedExact, " WWW ", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Pattern != "www" {
+		t.Errorf("pattern saved as %q", r.Pattern)
+	}
+}
+
+func TestRegisterReservedName(t *testing.T) {
+	setupTest(t)
+
+	if _, err := AddReservedName(ReservedExact, "www", "common name"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddReservedName(ReservedExact, "support", "common name"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddReservedName(ReservedGlob, "*calaos*", "trademark"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		mainzone, subzone string
+	}{
+		{"support", ""},
+		{"mycalaos", ""},
+		{"myhome", "www"},
+		{"myhome", "nas,calaos"},
+	} {
+		if err, _ := RegisterDns(c.mainzone, c.subzone, "", "1.2.3.4", "", "192.0.2.1"); err != ErrReservedName {
+			t.Errorf("RegisterDns(%v, %v): %v, want %v", c.mainzone, c.subzone, err, ErrReservedName)
+		}
+	}
+	if _, err := GetHostByName("myhome"); err != ErrUnknownHost {
+		t.Error("host registered with a reserved subzone:", err)
+	}
+
+	token := register(t, "myhome", "nas", "1.2.3.4", "")
+
+	//A subzone reserved after its registration is kept, but no new
+	//reserved subzone can be added
+	if _, err := AddReservedName(ReservedPrefix, "na", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err, _ := RegisterDns("myhome", "nas,cloud", token, "", "", "192.0.2.1"); err != nil {
+		t.Error("existing subzone refused:", err)
+	}
+	if err, _ := RegisterDns("myhome", "nas,nas2", token, "", "", "192.0.2.1"); err != ErrReservedName {
+		t.Errorf("new reserved subzone: %v, want %v", err, ErrReservedName)
+	}
+}
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// ZoneSerial is the serial of the zone served by the built-in DNS server. It
+// is kept in DB so that the changes made by the command line tools or by
+// another instance sharing the DB also increase it.
+type ZoneSerial struct {
+	ID     int64 `gorm:"primary_key"`
+	Serial uint32
+}
+
+const zoneSerialID = 1
+
+// GetZoneSerial returns the current serial of the zone
+func GetZoneSerial() (uint32, error) {
+	s := &ZoneSerial{}
+	if db.First(s, zoneSerialID).RecordNotFound() {
+		if err := bumpZoneSerial(); err != nil {
+			return 0, err
+		}
+	}
+
+	err := db.First(s, zoneSerialID).Error
+	return s.Serial, err
+}
+
+// bumpZoneSerial increases the serial of the zone after a change. The serial
+// is the unix time of the change, or the previous serial + 1 if it is not
+// older.
+func bumpZoneSerial() error {
+	for i := 0; i < 10; i++ {
+		next := uint32(time.Now().Unix())
+
+		s := &ZoneSerial{}
+		if db.First(s, zoneSerialID).RecordNotFound() {
+			if db.Create(&ZoneSerial{ID: zoneSerialID, Serial: next}).Error == nil {
+				return nil
+			}
+			continue //created by another process
+		}
+
+		if next <= s.Serial {
+			next = s.Serial + 1
+		}
+
+		//Only update the serial that was read, another process may have
+		//changed it in between
+		res := db.Model(&ZoneSerial{}).Where("id = ? AND serial = ?", zoneSerialID, s.Serial).UpdateColumn("serial", next)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 1 {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Zone serial is changed by another process")
+}
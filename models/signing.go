@@ -0,0 +1,290 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/calaos/calaos_dns/config"
+	"github.com/calaos/calaos_dns/utils"
+)
+
+// Errors of the signed requests
+var (
+	ErrSignatureRequired = fmt.Errorf("Signed request required")
+	ErrBadSignature      = fmt.Errorf("Invalid signature")
+	ErrStaleSignature    = fmt.Errorf("Request timestamp is out of the allowed window")
+	ErrReplayedRequest   = fmt.Errorf("Nonce already used")
+	ErrNoSigningSecret   = fmt.Errorf("No signing secret")
+	ErrSigningDisabled   = fmt.Errorf("Signed requests are disabled, no encryption key is set")
+)
+
+// RequestSignature is the signature of a request made by the client of a
+// host. It is the hex HMAC-SHA256 with the secret of the host of:
+//
+//	METHOD\nREQUEST_URI\nTIMESTAMP\nNONCE\nBODY
+type RequestSignature struct {
+	Method    string
+	URI       string
+	Body      []byte
+	Timestamp string //unix time in seconds
+	Nonce     string
+	Signature string
+}
+
+// signedString returns the data covered by the signature
+func (s *RequestSignature) signedString() []byte {
+	data := s.Method + "\n" + s.URI + "\n" + s.Timestamp + "\n" + s.Nonce + "\n"
+	return append([]byte(data), s.Body...)
+}
+
+// SignatureNonce is a nonce used by a signed request. It is kept in DB as
+// long as its request can pass the timestamp check, so that it can't be
+// replayed after a restart or on another instance.
+type SignatureNonce struct {
+	Nonce  string    `gorm:"primary_key"` //host id:nonce
+	UsedAt time.Time `gorm:"index"`
+}
+
+// Prefix of the encrypted signing secrets, older versions stored them in
+// clear text
+const encryptedSecretPrefix = "enc$"
+
+// signingKey returns the secret encrypting the signing secrets in DB
+func signingKey() string {
+	if config.Conf.Signing.EncryptionKey != "" {
+		return config.Conf.Signing.EncryptionKey
+	}
+	return config.Conf.Certificates.EncryptionKey
+}
+
+func encryptSigningSecret(secret string) (string, error) {
+	key := signingKey()
+	if key == "" {
+		return "", ErrSigningDisabled
+	}
+
+	data, err := utils.Encrypt(key, []byte(secret))
+	if err != nil {
+		return "", err
+	}
+	return encryptedSecretPrefix + hex.EncodeToString(data), nil
+}
+
+func decryptSigningSecret(stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedSecretPrefix) {
+		return stored, nil
+	}
+
+	key := signingKey()
+	if key == "" {
+		return "", ErrSigningDisabled
+	}
+
+	data, err := hex.DecodeString(strings.TrimPrefix(stored, encryptedSecretPrefix))
+	if err != nil {
+		return "", err
+	}
+	secret, err := utils.Decrypt(key, data)
+	return string(secret), err
+}
+
+// encryptSigningSecrets encrypts the signing secrets stored in clear text by
+// older versions. They stay in clear text until an encryption key is set.
+func encryptSigningSecrets() {
+	var hosts []Host
+	err := db.Where("signing_secret <> '' AND signing_secret NOT LIKE ?", encryptedSecretPrefix+"%").Find(&hosts).Error
+	if err != nil {
+		log.Println("Unable to query signing secrets from DB:", err)
+		return
+	}
+	if len(hosts) == 0 {
+		return
+	}
+
+	if signingKey() == "" {
+		log.Println("Warning:", len(hosts), "signing secrets are stored in clear text, set encryption_key in [signing] to encrypt them")
+		return
+	}
+
+	for _, h := range hosts {
+		secret, err := encryptSigningSecret(h.SigningSecret)
+		if err != nil {
+			log.Println("Unable to encrypt signing secret of", h.Hostname, ":", err)
+			return
+		}
+		if err = db.Model(&h).UpdateColumn("signing_secret", secret).Error; err != nil {
+			log.Println("Unable to save signing secret of", h.Hostname, ":", err)
+			return
+		}
+	}
+
+	log.Println("Encrypted", len(hosts), "signing secrets")
+}
+
+func signatureMaxAge() time.Duration {
+	age := config.Conf.Signing.MaxAge
+	if age <= 0 {
+		age = 300
+	}
+	return time.Duration(age) * time.Second
+}
+
+// VerifyRequest checks the signature of a request made with token and returns
+// the host of the token if it is allowed for scope. The token is only looked
+// up here, the host is then passed to the operation of the request. A request
+// without signature (sig is nil) is only accepted if the host of the token is
+// not signed only.
+func VerifyRequest(token, scope string, sig *RequestSignature) (h *Host, err error) {
+	t, err := findToken(token, scope)
+	if err != nil {
+		return
+	}
+
+	h, err = tokenHost(t)
+	if err != nil {
+		return
+	}
+
+	if err = verifySignature(h, sig); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// verifySignature checks the signature of a request to the host h
+func verifySignature(h *Host, sig *RequestSignature) (err error) {
+	if sig == nil {
+		if h.SignedOnly {
+			log.Println("Unsigned request refused for host", h.Hostname)
+			return ErrSignatureRequired
+		}
+		return nil
+	}
+
+	if h.SigningSecret == "" {
+		return ErrNoSigningSecret
+	}
+
+	secret, err := decryptSigningSecret(h.SigningSecret)
+	if err != nil {
+		log.Println("Unable to decrypt signing secret of", h.Hostname, ":", err)
+		return fmt.Errorf("Internal error")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(sig.signedString())
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(sig.Signature)) {
+		log.Println("Invalid signature for host", h.Hostname)
+		return ErrBadSignature
+	}
+
+	ts, err := strconv.ParseInt(sig.Timestamp, 10, 64)
+	if err != nil {
+		return ErrStaleSignature
+	}
+
+	maxAge := signatureMaxAge()
+	now := time.Now()
+	d := now.Sub(time.Unix(ts, 0))
+	if d > maxAge || d < -maxAge {
+		log.Println("Stale signed request for host", h.Hostname, ", time difference:", d)
+		return ErrStaleSignature
+	}
+
+	if sig.Nonce == "" || len(sig.Nonce) > 64 {
+		return ErrBadSignature
+	}
+
+	return useNonce(strconv.FormatInt(h.ID, 10)+":"+sig.Nonce, now)
+}
+
+// useNonce records a nonce of a host, it can't be used again while its
+// request can pass the timestamp check
+func useNonce(key string, now time.Time) error {
+	err := db.Create(&SignatureNonce{Nonce: key, UsedAt: now}).Error
+	if err == nil {
+		return nil
+	}
+
+	if !db.Where("nonce = ?", key).First(&SignatureNonce{}).RecordNotFound() {
+		log.Println("Replayed signed request, nonce:", key)
+		return ErrReplayedRequest
+	}
+
+	log.Println("Unable to save nonce in DB:", err)
+	return fmt.Errorf("Internal error")
+}
+
+// pruneNonces removes the nonces whose requests are now refused by the
+// timestamp check
+func pruneNonces() {
+	limit := time.Now().Add(-2 * signatureMaxAge())
+	if err := db.Where("used_at < ?", limit).Delete(&SignatureNonce{}).Error; err != nil {
+		log.Println("Unable to prune nonces from DB:", err)
+	}
+}
+
+// CreateSigningSecret generates a new signing secret for the host. The
+// previous secret is replaced.
+func CreateSigningSecret(h *Host) (secret string, err error) {
+	secret = utils.TokenGenerator()
+	encrypted, err := encryptSigningSecret(secret)
+	if err == ErrSigningDisabled {
+		return "", err
+	}
+	if err != nil {
+		log.Println("Unable to encrypt signing secret:", err)
+		return "", fmt.Errorf("Internal error")
+	}
+
+	log.Println("Creating signing secret for", h.Hostname)
+
+	if err = db.Model(h).UpdateColumn("signing_secret", encrypted).Error; err != nil {
+		log.Println("Unable to save signing secret:", err)
+		return "", fmt.Errorf("Internal error")
+	}
+	h.SigningSecret = encrypted
+
+	return
+}
+
+// SetSignedOnly changes whether unsigned requests are refused for the host
+func SetSignedOnly(h *Host, signedOnly bool) (err error) {
+	if signedOnly && h.SigningSecret == "" {
+		return ErrNoSigningSecret
+	}
+
+	log.Println("Setting signed only of", h.Hostname, "to", signedOnly)
+
+	if err = db.Model(h).UpdateColumn("signed_only", signedOnly).Error; err != nil {
+		log.Println("Unable to save host:", err)
+		return fmt.Errorf("Internal error")
+	}
+	h.SignedOnly = signedOnly
+
+	return
+}
+
+// RemoveSigningSecret removes the signing secret of the host, unsigned
+// requests are accepted again
+func RemoveSigningSecret(h *Host) (err error) {
+	log.Println("Removing signing secret of", h.Hostname)
+
+	err = db.Model(h).UpdateColumns(map[string]interface{}{"signing_secret": "", "signed_only": false}).Error
+	if err != nil {
+		log.Println("Unable to save host:", err)
+		return fmt.Errorf("Internal error")
+	}
+	h.SigningSecret = ""
+	h.SignedOnly = false
+
+	return
+}
@@ -0,0 +1,179 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calaos/calaos_dns/config"
+)
+
+// signRequest returns a request signed with secret at time ts
+func signRequest(secret string, ts time.Time, nonce string) *RequestSignature {
+	sig := &RequestSignature{
+		Method:    "GET",
+		URI:       "/api/update",
+		Body:      []byte("ip=1.2.3.4"),
+		Timestamp: strconv.FormatInt(ts.Unix(), 10),
+		Nonce:     nonce,
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(sig.signedString())
+	sig.Signature = hex.EncodeToString(mac.Sum(nil))
+	return sig
+}
+
+// verify is VerifyRequest without scope
+func verify(token string, sig *RequestSignature) error {
+	_, err := VerifyRequest(token, "", sig)
+	return err
+}
+
+func TestVerifyRequest(t *testing.T) {
+	setupTest(t)
+	config.Conf.Signing.EncryptionKey = "signing-test-key"
+
+	token := register(t, "myhome", "", "1.2.3.4", "")
+	h, err := GetHostByName("myhome")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Requests are not signed until the host has a secret
+	if err = verify(token, nil); err != nil {
+		t.Fatal("unsigned request refused:", err)
+	}
+	if err = verify(token, signRequest("secret", time.Now(), "nonce0")); err != ErrNoSigningSecret {
+		t.Error("signed request without secret:", err)
+	}
+
+	secret, err := CreateSigningSecret(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//The secret is encrypted in DB
+	stored := &Host{}
+	db.First(stored, h.ID)
+	if !strings.HasPrefix(stored.SigningSecret, encryptedSecretPrefix) || strings.Contains(stored.SigningSecret, secret) {
+		t.Errorf("signing secret stored as %v", stored.SigningSecret)
+	}
+
+	now := time.Now()
+	badMac := signRequest(secret, now, "nonce2")
+	badMac.Signature = strings.Repeat("0", len(badMac.Signature))
+	otherBody := signRequest(secret, now, "nonce3")
+	otherBody.Body = []byte("ip=6.6.6.6")
+
+	for _, c := range []struct {
+		name string
+		sig  *RequestSignature
+		want error
+	}{
+		{"valid", signRequest(secret, now, "nonce1"), nil},
+		{"reused nonce", signRequest(secret, now, "nonce1"), ErrReplayedRequest},
+		{"bad mac", badMac, ErrBadSignature},
+		{"changed body", otherBody, ErrBadSignature},
+		{"wrong secret", signRequest("other", now, "nonce4"), ErrBadSignature},
+		{"old timestamp", signRequest(secret, now.Add(-10*time.Minute), "nonce5"), ErrStaleSignature},
+		{"future timestamp", signRequest(secret, now.Add(10*time.Minute), "nonce6"), ErrStaleSignature},
+		{"no nonce", signRequest(secret, now, ""), ErrBadSignature},
+		{"unsigned", nil, nil},
+	} {
+		if err := verify(token, c.sig); err != c.want {
+			t.Errorf("%v: %v, want %v", c.name, err, c.want)
+		}
+	}
+
+	//Signed only hosts refuse unsigned requests
+	if err = SetSignedOnly(h, true); err != nil {
+		t.Fatal(err)
+	}
+	if err = verify(token, nil); err != ErrSignatureRequired {
+		t.Error("unsigned request to signed only host:", err)
+	}
+	if err = verify(token, signRequest(secret, now, "nonce7")); err != nil {
+		t.Error("signed request to signed only host refused:", err)
+	}
+
+	if err = verify("wrongtoken", signRequest(secret, now, "nonce8")); err == nil {
+		t.Error("request with a wrong token accepted")
+	}
+
+	//The host of the token is returned if its scope allows the request
+	acme, _, err := CreateToken(h, "acme", ScopeAcme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = VerifyRequest(acme, ScopeUpdate, signRequest(secret, now, "nonce9")); err == nil {
+		t.Error("acme token allowed for update")
+	}
+	vh, err := VerifyRequest(acme, ScopeAcme, signRequest(secret, now, "nonce10"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vh.ID != h.ID {
+		t.Errorf("request verified for host %v, want %v", vh.Hostname, h.Hostname)
+	}
+}
+
+func TestNonces(t *testing.T) {
+	setupTest(t)
+
+	now := time.Now()
+	if err := useNonce("1:nonce", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := useNonce("1:nonce", now); err != ErrReplayedRequest {
+		t.Error("nonce used twice:", err)
+	}
+	if err := useNonce("2:nonce", now); err != nil {
+		t.Error("nonce of another host refused:", err)
+	}
+
+	//Only the nonces too old to pass the timestamp check are removed
+	db.Model(&SignatureNonce{}).Where("nonce = ?", "2:nonce").UpdateColumn("used_at", now.Add(-time.Hour))
+	pruneNonces()
+	if err := useNonce("1:nonce", now); err != ErrReplayedRequest {
+		t.Error("nonce pruned too early:", err)
+	}
+	if err := useNonce("2:nonce", now); err != nil {
+		t.Error("old nonce not pruned:", err)
+	}
+}
+
+func TestEncryptSigningSecrets(t *testing.T) {
+	setupTest(t)
+
+	token := register(t, "myhome", "", "1.2.3.4", "")
+	h, err := GetHostByName("myhome")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Secret stored in clear text by an older version
+	db.Model(h).UpdateColumn("signing_secret", "legacy-secret")
+
+	//It stays in clear text until a key is set
+	encryptSigningSecrets()
+	if err = verify(token, signRequest("legacy-secret", time.Now(), "nonce1")); err != nil {
+		t.Fatal(err)
+	}
+
+	config.Conf.Signing.EncryptionKey = "signing-test-key"
+	encryptSigningSecrets()
+
+	stored := &Host{}
+	db.First(stored, h.ID)
+	if !strings.HasPrefix(stored.SigningSecret, encryptedSecretPrefix) {
+		t.Errorf("signing secret stored as %v", stored.SigningSecret)
+	}
+	if err = verify(token, signRequest("legacy-secret", time.Now(), "nonce2")); err != nil {
+		t.Error("encrypted legacy secret refused:", err)
+	}
+}
@@ -0,0 +1,276 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/calaos/calaos_dns/models/orm"
+	"github.com/calaos/calaos_dns/utils"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Scopes of the tokens
+const (
+	ScopeFull   = "full"   //everything, including the management of the host and its tokens
+	ScopeUpdate = "update" //update of the addresses only
+	ScopeAcme   = "acme"   //letsencrypt challenges and certificates only
+)
+
+// Token is a credential of a host. Only a salted hash of the token is
+// stored, with a short prefix to find it.
+type Token struct {
+	ID         int64      `gorm:"primary_key" json:"id"`
+	HostID     int64      `gorm:"index" json:"-"`
+	Label      string     `json:"label"`
+	Scope      string     `json:"scope"`
+	Hash       string     `json:"-"`
+	Prefix     string     `gorm:"index" json:"prefix"`
+	CreatedAt  *time.Time `gorm:"type:timestamp" json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Minimum interval between two saves of the last use of a token, a token
+// used by every request is not written to DB each time
+const tokenUseInterval = time.Minute
+
+// ValidScope returns true if scope is one of the token scopes
+func ValidScope(scope string) bool {
+	return scope == ScopeFull || scope == ScopeUpdate || scope == ScopeAcme
+}
+
+// allows returns true if the token can be used for an operation of scope
+func (t *Token) allows(scope string) bool {
+	return t.Scope == ScopeFull || t.Scope == scope
+}
+
+// createToken generates a new token for the host. The token is only returned
+// here, the DB keeps its hash.
+func createToken(tx *gorm.DB, hostID int64, label, scope string) (token string, t *Token, err error) {
+	token = utils.TokenGenerator()
+	t = &Token{
+		HostID: hostID,
+		Label:  label,
+		Scope:  scope,
+		Hash:   utils.HashToken(token),
+		Prefix: utils.TokenPrefix(token),
+	}
+
+	err = tx.Create(t).Error
+	return
+}
+
+// findToken returns the valid token matching token and allowed for scope.
+// The scope is not checked if it is empty.
+func findToken(token, scope string) (t *Token, err error) {
+	if len(token) >= utils.TokenPrefixLen {
+		var tokens []Token
+		params := map[string]interface{}{
+			"prefix": utils.TokenPrefix(token),
+		}
+		err = orm.FindByQueryMap(db, &tokens, params)
+		if err == nil {
+			for i := range tokens {
+				if tokens[i].RevokedAt == nil && utils.VerifyToken(token, tokens[i].Hash) {
+					t = &tokens[i]
+					break
+				}
+			}
+		}
+	}
+
+	if t == nil {
+		log.Println("Token has not been found")
+		return nil, fmt.Errorf("Unknown token")
+	}
+
+	if scope != "" && !t.allows(scope) {
+		log.Println("Token", t.ID, "with scope", t.Scope, "used for", scope)
+		return nil, fmt.Errorf("Token not allowed for this operation")
+	}
+
+	now := time.Now()
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) >= tokenUseInterval {
+		t.LastUsedAt = &now
+		db.Model(t).UpdateColumn("last_used_at", now)
+	}
+
+	return
+}
+
+// GetHostByToken returns the host of token if the token is allowed for scope
+func GetHostByToken(token, scope string) (h *Host, err error) {
+	t, err := findToken(token, scope)
+	if err != nil {
+		return
+	}
+
+	return tokenHost(t)
+}
+
+// tokenHost returns the host of the token t, unless it is suspended
+func tokenHost(t *Token) (h *Host, err error) {
+	h = &Host{}
+	if err = db.First(h, t.HostID).Error; err != nil {
+		log.Println("Host of token", t.ID, "has not been found:", err)
+		return nil, fmt.Errorf("Unknown token")
+	}
+
+	if h.Suspended() {
+		log.Println("Host", h.Hostname, "is suspended")
+		return nil, ErrHostSuspended
+	}
+
+	return
+}
+
+// ListTokens returns all tokens of the host, including the revoked ones
+func ListTokens(h *Host) (tokens []Token, err error) {
+	err = db.Where("host_id = ?", h.ID).Order("id").Find(&tokens).Error
+	if err != nil {
+		log.Println("Unable to query tokens from DB:", err)
+	}
+	return
+}
+
+// CreateToken adds a token with scope to the host
+func CreateToken(h *Host, label, scope string) (token string, t *Token, err error) {
+	if !ValidScope(scope) {
+		return "", nil, fmt.Errorf("Invalid scope")
+	}
+
+	log.Println("Creating", scope, "token", label, "for", h.Hostname)
+
+	token, t, err = createToken(db, h.ID, label, scope)
+	if err != nil {
+		log.Println("Unable to add token to DB:", err)
+		return "", nil, fmt.Errorf("Internal error")
+	}
+
+	return
+}
+
+// RotateToken replaces the token id of the host by a new one with the same
+// label and scope. The old token is revoked.
+func RotateToken(h *Host, id int64) (token string, t *Token, err error) {
+	old, err := hostToken(h, id)
+	if err != nil {
+		return
+	}
+
+	log.Println("Rotating token", id, "of", h.Hostname)
+
+	err = orm.Transaction(db, func(tx *gorm.DB) error {
+		if err := tx.Model(old).UpdateColumn("revoked_at", time.Now()).Error; err != nil {
+			return err
+		}
+
+		var err error
+		token, t, err = createToken(tx, h.ID, old.Label, old.Scope)
+		return err
+	})
+	if err != nil {
+		log.Println("Unable to rotate token:", err)
+		return "", nil, fmt.Errorf("Internal error")
+	}
+
+	return
+}
+
+// RevokeToken revokes the token id of the host. The last full token of a
+// host cannot be revoked.
+func RevokeToken(h *Host, id int64) (err error) {
+	t, err := hostToken(h, id)
+	if err != nil {
+		return
+	}
+
+	if t.Scope == ScopeFull {
+		var count int
+		db.Model(&Token{}).Where("host_id = ? AND scope = ? AND revoked_at IS NULL", h.ID, ScopeFull).Count(&count)
+		if count <= 1 {
+			return fmt.Errorf("Cannot revoke the last full token")
+		}
+	}
+
+	log.Println("Revoking token", id, "of", h.Hostname)
+
+	err = db.Model(t).UpdateColumn("revoked_at", time.Now()).Error
+	if err != nil {
+		log.Println("Unable to revoke token:", err)
+		return fmt.Errorf("Internal error")
+	}
+
+	return
+}
+
+// hostToken returns the valid token id of the host
+func hostToken(h *Host, id int64) (t *Token, err error) {
+	t = &Token{}
+	if db.Where("id = ? AND host_id = ? AND revoked_at IS NULL", id, h.ID).First(t).RecordNotFound() {
+		return nil, fmt.Errorf("Unknown token")
+	}
+	return
+}
+
+// migrateTokens moves the tokens stored in the hosts table by older versions
+// to the tokens table
+func migrateTokens() {
+	//tokens in clear text
+	if db.Dialect().HasColumn("hosts", "token") {
+		migrateHostTokens("token", "id, token, ''", true)
+	}
+
+	//hashed tokens
+	if db.Dialect().HasColumn("hosts", "token_hash") {
+		migrateHostTokens("token_hash", "id, token_hash, token_prefix", false)
+	}
+}
+
+// migrateHostTokens creates a full token for each host with a value in column.
+// fields selects the host id, the value and its prefix.
+func migrateHostTokens(column, fields string, plaintext bool) {
+	rows, err := db.Table("hosts").Select(fields).Where(column + " IS NOT NULL AND " + column + " <> ''").Rows()
+	if err != nil {
+		log.Println("Unable to query tokens of hosts from DB:", err)
+		return
+	}
+
+	var tokens []Token
+	for rows.Next() {
+		var id int64
+		var value, prefix string
+		if err = rows.Scan(&id, &value, &prefix); err != nil {
+			log.Println("Unable to read token of host from DB:", err)
+			rows.Close()
+			return
+		}
+
+		t := Token{HostID: id, Label: "default", Scope: ScopeFull, Hash: value, Prefix: prefix}
+		if plaintext {
+			t.Hash = utils.HashToken(value)
+			t.Prefix = utils.TokenPrefix(value)
+		}
+		tokens = append(tokens, t)
+	}
+	rows.Close()
+
+	for _, t := range tokens {
+		err = orm.Transaction(db, func(tx *gorm.DB) error {
+			if err := tx.Create(&t).Error; err != nil {
+				return err
+			}
+			return tx.Table("hosts").Where("id = ?", t.HostID).UpdateColumn(column, "").Error
+		})
+		if err != nil {
+			log.Println("Unable to migrate token of host", t.HostID, ":", err)
+			return
+		}
+	}
+
+	if len(tokens) > 0 {
+		log.Println("Migrated", len(tokens), "tokens of hosts from column", column)
+	}
+}
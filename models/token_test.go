@@ -0,0 +1,144 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calaos/calaos_dns/utils"
+)
+
+// columnValue returns the value of column in the hosts table for hostname
+func columnValue(t *testing.T, column, hostname string) string {
+	t.Helper()
+
+	var value string
+	row := db.Table("hosts").Select(column).Where("hostname = ?", hostname).Row()
+	if err := row.Scan(&value); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestMigrateTokens(t *testing.T) {
+	setupTest(t)
+
+	//Tokens stored in the hosts table by older versions, in clear text or
+	//hashed
+	for _, column := range []string{"token", "token_hash", "token_prefix"} {
+		if err := db.Exec("ALTER TABLE hosts ADD COLUMN " + column + " varchar(255)").Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	plain := utils.TokenGenerator()
+	hashed := utils.TokenGenerator()
+	for _, h := range []struct {
+		hostname, token, hash, prefix string
+	}{
+		{"plain", plain, "", ""},
+		{"hashed", "", utils.HashToken(hashed), utils.TokenPrefix(hashed)},
+	} {
+		err := db.Exec("INSERT INTO hosts (hostname, token, token_hash, token_prefix) VALUES (?, ?, ?, ?)",
+			h.hostname, h.token, h.hash, h.prefix).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	migrateTokens()
+
+	for hostname, token := range map[string]string{"plain": plain, "hashed": hashed} {
+		h, err := GetHostByToken(token, ScopeFull)
+		if err != nil {
+			t.Errorf("migrated token of %v refused: %v", hostname, err)
+		} else if h.Hostname != hostname {
+			t.Errorf("migrated token of %v gives host %v", hostname, h.Hostname)
+		}
+	}
+
+	//The clear text token is gone from DB
+	if v := columnValue(t, "token", "plain"); v != "" {
+		t.Errorf("token left in hosts table: %v", v)
+	}
+	if v := columnValue(t, "token_hash", "hashed"); v != "" {
+		t.Errorf("token hash left in hosts table: %v", v)
+	}
+	var tokens []Token
+	db.Find(&tokens)
+	for _, tk := range tokens {
+		if strings.Contains(tk.Hash, plain) {
+			t.Errorf("token %v stored in clear text", tk.ID)
+		}
+	}
+
+	//Migrating again does not duplicate the tokens
+	migrateTokens()
+	var count int
+	db.Model(&Token{}).Count(&count)
+	if count != 2 {
+		t.Errorf("%v tokens after a second migration, want 2", count)
+	}
+}
+
+func TestFindToken(t *testing.T) {
+	setupTest(t)
+
+	token := register(t, "myhome", "", "1.2.3.4", "")
+	h, err := GetHostByName("myhome")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t1, err := findToken(token, ScopeFull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if t1.LastUsedAt == nil {
+		t.Fatal("last use of the token not saved")
+	}
+
+	//The last use is only saved again after a while
+	t2, err := findToken(token, ScopeFull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !t2.LastUsedAt.Equal(*t1.LastUsedAt) {
+		t.Errorf("last use saved again after %v", t2.LastUsedAt.Sub(*t1.LastUsedAt))
+	}
+	db.Model(t1).UpdateColumn("last_used_at", time.Now().Add(-2*tokenUseInterval))
+	t3, err := findToken(token, ScopeFull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(*t3.LastUsedAt) > time.Minute {
+		t.Errorf("last use not saved after %v", tokenUseInterval)
+	}
+
+	//Another token with the same prefix is refused
+	wrong := utils.TokenPrefix(token) + strings.Repeat("x", len(token)-utils.TokenPrefixLen)
+	if _, err = findToken(wrong, ""); err == nil {
+		t.Error("token with the right prefix and a wrong suffix accepted")
+	}
+	if _, err = findToken(utils.TokenPrefix(token), ""); err == nil {
+		t.Error("prefix of a token accepted")
+	}
+
+	//Scopes and revocation
+	acme, tk, err := CreateToken(h, "acme", ScopeAcme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = findToken(acme, ScopeUpdate); err == nil {
+		t.Error("acme token allowed for update")
+	}
+	if _, err = findToken(acme, ScopeAcme); err != nil {
+		t.Error("acme token refused:", err)
+	}
+	if err = RevokeToken(h, tk.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = findToken(acme, ""); err == nil {
+		t.Error("revoked token accepted")
+	}
+}
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Number of characters of a token kept in clear text to find it in DB
+const TokenPrefixLen = 6
+
+// TokenPrefix returns the lookup prefix of token
+func TokenPrefix(token string) string {
+	if len(token) < TokenPrefixLen {
+		return token
+	}
+	return token[:TokenPrefixLen]
+}
+
+// RedactToken returns the token as it can be written in logs. Only the
+// lookup prefix of long tokens is kept, so that a token can still be told
+// apart in the logs.
+func RedactToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	if len(token) < 3*TokenPrefixLen {
+		return "***"
+	}
+	return TokenPrefix(token) + "***"
+}
+
+// HashToken returns the salted hash of token stored in DB, formatted as
+// sha256$salt$hash
+func HashToken(token string) string {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	return "sha256$" + hex.EncodeToString(salt) + "$" + hex.EncodeToString(saltedHash(salt, token))
+}
+
+// VerifyToken returns true if token matches a hash returned by HashToken
+func VerifyToken(token, hash string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 3 || parts[0] != "sha256" {
+		return false
+	}
+
+	salt, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	want, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(saltedHash(salt, token), want) == 1
+}
+
+func saltedHash(salt []byte, token string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(token))
+	return h.Sum(nil)
+}
+
+func secretCipher(secret string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Encrypt encrypts data with AES-GCM using a key derived from secret. The
+// random nonce is prepended to the result.
+func Encrypt(secret string, data []byte) ([]byte, error) {
+	gcm, err := secretCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+// Decrypt decrypts data returned by Encrypt with the same secret
+func Decrypt(secret string, data []byte) ([]byte, error) {
+	gcm, err := secretCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("Encrypted data is too short")
+	}
+
+	nonce := data[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, data[gcm.NonceSize():], nil)
+}
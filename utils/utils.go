@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -33,11 +34,20 @@ func CreateDir(cacheDir string, cacheperm os.FileMode) {
 }
 
 func TokenGenerator() string {
-	b := make([]byte, 8)
+	b := make([]byte, 20)
 	rand.Read(b)
 	return fmt.Sprintf("%x", b)
 }
 
+// UUIDGenerator returns a random (version 4) UUID
+func UUIDGenerator() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
 func IsValidHostname(host string) (string, bool) {
 	valid, _ := regexp.Match("^[a-z0-9]{4,32}$", []byte(host))
 
@@ -50,6 +60,26 @@ func IsValidSubHostname(host string) (string, bool) {
 	return host, valid
 }
 
+// IsValidIPv4 returns the canonical form of ip if it is an IPv4 address
+func IsValidIPv4(ip string) (string, bool) {
+	p := net.ParseIP(ip)
+	if p == nil || p.To4() == nil {
+		return ip, false
+	}
+
+	return p.To4().String(), true
+}
+
+// IsValidIPv6 returns the canonical form of ip if it is an IPv6 address
+func IsValidIPv6(ip string) (string, bool) {
+	p := net.ParseIP(ip)
+	if p == nil || p.To4() != nil {
+		return ip, false
+	}
+
+	return p.String(), true
+}
+
 func StringInSlice(a string, list []string) bool {
 	for _, b := range list {
 		if b == a {